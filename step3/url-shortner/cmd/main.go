@@ -1,29 +1,183 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
 	"url-shortner/internal/api"
 	"url-shortner/internal/config"
+	"url-shortner/internal/idgen"
+	"url-shortner/internal/metrics"
+	"url-shortner/internal/store"
+	"url-shortner/internal/tracing"
 
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func main() {
-	e := api.SetupRouter()
+// setupTimeout bounds index creation and migrations at startup. The first
+// index build on a large collection can take a while.
+const setupTimeout = 2 * time.Minute
 
+func main() {
 	config.LoadConfig()
 
-	api.RedisClient = redis.NewClient(&redis.Options{
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	redisClient := redis.NewClient(&redis.Options{
 		Addr: config.AppConfig.RedisHost,
 	})
+	if err := redisotel.InstrumentTracing(redisClient); err != nil {
+		log.Fatal(err)
+	}
 
-	client, err := mongo.Connect(api.Ctx, options.Client().ApplyURI("mongodb://"+config.AppConfig.MongoHost))
+	client, err := mongo.Connect(ctx, options.Client().
+		ApplyURI("mongodb://"+config.AppConfig.MongoHost).
+		SetMonitor(tracing.CommandMonitor(metrics.CommandMonitor())))
 	if err != nil {
 		log.Fatal(err)
 	}
-	api.MongoCol = client.Database(config.AppConfig.MongoDatabase).Collection(config.AppConfig.MongoCollection)
+	links := store.NewMongoStore(
+		client.Database(config.AppConfig.MongoDatabase),
+		config.AppConfig.MongoCollection,
+		config.AppConfig.ClickCollection,
+		config.AppConfig.KeyCollection,
+		config.AppConfig.MigrationCollection,
+		config.AppConfig.TombstoneRetention,
+	)
+
+	// Every replica runs this on startup; both steps are idempotent, so
+	// concurrent runs are safe.
+	setupCtx, cancelSetup := context.WithTimeout(ctx, setupTimeout)
+	if err := links.EnsureIndexes(setupCtx); err != nil {
+		log.Fatalf("creating MongoDB indexes: %v", err)
+	}
+	if err := links.Migrate(setupCtx); err != nil {
+		log.Fatalf("migrating MongoDB: %v", err)
+	}
+	cancelSetup()
+
+	var cache store.Cache = store.NewRedisCache(redisClient)
+	var filter store.Filter
+	if bits := config.AppConfig.BloomBits; bits > 0 {
+		filter = store.NewBloomFilter(redisClient, "bloom:links", bits, config.AppConfig.BloomHashes)
+	}
+	// The cache and the filter live in the same Redis, so they share one
+	// breaker.
+	if n := config.AppConfig.CacheBreakerFailures; n > 0 {
+		breaker := store.NewBreaker(n, config.AppConfig.CacheBreakerCooldown)
+		cache = store.NewBreakerCache(cache, breaker)
+		if filter != nil {
+			filter = store.NewBreakerFilter(filter, breaker)
+		}
+	}
+
+	ids, err := idgen.New(idgen.Options{
+		Strategy: config.AppConfig.IDStrategy,
+		Length:   config.AppConfig.IDLength,
+		Alphabet: config.AppConfig.IDAlphabet,
+		Secret:   config.AppConfig.IDSecret,
+		Node:     config.AppConfig.IDNode,
+	}, cache)
+	if err != nil {
+		log.Fatalf("configuring ID generation: %v", err)
+	}
+
+	srv := api.NewServer(links, cache)
+	srv.Filter = filter
+	srv.IDs = ids
+	e := srv.SetupRouter()
+
+	if path := config.AppConfig.BlocklistFile; path != "" {
+		if err := api.WatchBlocklist(ctx, path); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// The recorder outlives ctx: it is stopped only once the server has
+	// drained, so clicks from in-flight redirects still get flushed.
+	recorderCtx, stopRecorder := context.WithCancel(context.Background())
+	recorderDone := make(chan struct{})
+	go func() {
+		srv.RunClickRecorder(recorderCtx)
+		close(recorderDone)
+	}()
+
+	go srv.RunFilterRefresher(ctx)
+
+	if interval := config.AppConfig.ActiveLinksInterval; interval > 0 {
+		go metrics.RunActiveLinks(ctx, interval, links.CountActive)
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- e.Start("0.0.0.0:" + config.AppConfig.Port)
+	}()
+
+	// Metrics get their own listener so the ingress, which only routes to
+	// the http port, never exposes them.
+	var metricsServer *http.Server
+	if port := config.AppConfig.MetricsPort; port != "" && port != "0" {
+		metricsServer = &http.Server{Addr: "0.0.0.0:" + port, Handler: metrics.Handler()}
+		go func() {
+			if err := metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("metrics server: %v", err)
+			}
+		}()
+	}
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	case <-ctx.Done():
+	}
+	stop()
 
-	e.Logger.Fatal(e.Start("0.0.0.0:" + config.AppConfig.Port))
+	// Fail readiness but keep serving while Kubernetes removes the pod from
+	// the Service endpoints, otherwise requests routed meanwhile are refused.
+	srv.Drain()
+	log.Printf("shutting down in %s", config.AppConfig.ShutdownDelay)
+	time.Sleep(config.AppConfig.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.AppConfig.ShutdownTimeout)
+	defer cancel()
+
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server shutdown: %v", err)
+	}
+	if metricsServer != nil {
+		metricsServer.Shutdown(shutdownCtx)
+	}
+
+	stopRecorder()
+	select {
+	case <-recorderDone:
+	case <-shutdownCtx.Done():
+		log.Print("gave up waiting for the click recorder")
+	}
+
+	if err := client.Disconnect(shutdownCtx); err != nil {
+		log.Printf("MongoDB disconnect: %v", err)
+	}
+	if err := redisClient.Close(); err != nil {
+		log.Printf("Redis close: %v", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("flushing spans: %v", err)
+	}
+	log.Print("shutdown complete")
 }
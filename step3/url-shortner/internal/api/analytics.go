@@ -0,0 +1,150 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	clickBufferSize    = 4096
+	clickBatchSize     = 256
+	clickFlushInterval = time.Second
+)
+
+// recordClick queues a click for the background recorder. It never blocks
+// the redirect: when the buffer is full the event is dropped.
+func (s *Server) recordClick(c echo.Context, id string) {
+	req := c.Request()
+	click := store.Click{
+		ShortID:   id,
+		Timestamp: time.Now().UTC(),
+		Referrer:  req.Referer(),
+		Agent:     agentClass(req.UserAgent()),
+		Visitor:   visitorID(c.RealIP(), req.UserAgent()),
+	}
+	select {
+	case s.clicks <- click:
+	default:
+		log.Printf("click buffer full, dropping click for %s", id)
+	}
+}
+
+// RunClickRecorder drains queued clicks into the LinkStore in batches until
+// ctx is cancelled, flushing whatever is left before returning. Cancel it
+// only after the HTTP server has stopped so late clicks are not lost.
+func (s *Server) RunClickRecorder(ctx context.Context) {
+	ticker := time.NewTicker(clickFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]store.Click, 0, clickBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := withOpTimeout(context.Background())
+		defer cancel()
+		if err := s.Links.RecordClicks(ctx, batch); err != nil {
+			log.Printf("recording %d clicks failed: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case click := <-s.clicks:
+			batch = append(batch, click)
+			if len(batch) == clickBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case click := <-s.clicks:
+					batch = append(batch, click)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) linkStats(c echo.Context) error {
+	id := c.Param("hsh")
+
+	ctx, cancel := opContext(c)
+	url, err := s.Links.Get(ctx, id)
+	cancel()
+	if err == store.ErrNotFound || err == store.ErrDeleted {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "URL not found"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "DB lookup failed"})
+	}
+
+	now := time.Now().UTC()
+	ctx, cancel = opContext(c)
+	defer cancel()
+	stats, err := s.Links.ClickStats(ctx, id, url.CreatedAt, now.Add(-24*time.Hour), now.AddDate(0, 0, -30))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "stats query failed"})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"id":              id,
+		"total_clicks":    stats.Total,
+		"unique_visitors": stats.Unique,
+		"hourly":          nonNil(stats.Hourly),
+		"daily":           nonNil(stats.Daily),
+	})
+}
+
+func nonNil(b []store.ClickBucket) []store.ClickBucket {
+	if b == nil {
+		return []store.ClickBucket{}
+	}
+	return b
+}
+
+// agentClass reduces a User-Agent header to a coarse client class so raw
+// user agents are never stored.
+func agentClass(ua string) string {
+	ua = strings.ToLower(ua)
+	switch {
+	case ua == "":
+		return "unknown"
+	case containsAny(ua, "bot", "crawler", "spider", "curl", "wget", "python-requests", "go-http-client"):
+		return "bot"
+	case containsAny(ua, "ipad", "tablet"):
+		return "tablet"
+	case containsAny(ua, "mobile", "android", "iphone"):
+		return "mobile"
+	default:
+		return "desktop"
+	}
+}
+
+func containsAny(s string, subs ...string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// visitorID is a one-way fingerprint used only for unique visitor counts.
+func visitorID(ip, ua string) string {
+	sum := sha256.Sum256([]byte(ip + "|" + ua))
+	return hex.EncodeToString(sum[:12])
+}
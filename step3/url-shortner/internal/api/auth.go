@@ -0,0 +1,178 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"url-shortner/internal/config"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+const apiKeyContextKey = "api_key"
+
+var adminKey = &store.APIKey{Hash: "admin", Owner: "admin", Admin: true}
+
+// authenticate attaches the caller's API key to the request when one is
+// sent. Anonymous requests pass through; an unknown key is rejected.
+func (s *Server) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		raw := apiKeyFromRequest(c.Request())
+		if raw == "" {
+			return next(c)
+		}
+
+		if admin := config.AppConfig.AdminAPIKey; admin != "" &&
+			subtle.ConstantTimeCompare([]byte(raw), []byte(admin)) == 1 {
+			c.Set(apiKeyContextKey, adminKey)
+			return next(c)
+		}
+
+		ctx, cancel := opContext(c)
+		key, err := s.Links.APIKey(ctx, hashAPIKey(raw))
+		cancel()
+		if err == store.ErrNotFound {
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "invalid API key"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "API key lookup failed"})
+		}
+		c.Set(apiKeyContextKey, &key)
+		return next(c)
+	}
+}
+
+// requireAPIKey must run after authenticate.
+func requireAPIKey(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if apiKeyOf(c) == nil {
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "API key required"})
+		}
+		return next(c)
+	}
+}
+
+// requireAdmin must run after authenticate.
+func requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := apiKeyOf(c)
+		if key == nil {
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "API key required"})
+		}
+		if !key.Admin {
+			return c.JSON(http.StatusForbidden, echo.Map{"error": "admin API key required"})
+		}
+		return next(c)
+	}
+}
+
+func apiKeyOf(c echo.Context) *store.APIKey {
+	key, _ := c.Get(apiKeyContextKey).(*store.APIKey)
+	return key
+}
+
+// ownerOf returns the owner recorded on links created by this request, or
+// "" for anonymous callers.
+func ownerOf(c echo.Context) string {
+	if key := apiKeyOf(c); key != nil {
+		return key.Owner
+	}
+	return ""
+}
+
+// scopeOwner is the owner writes must be restricted to, or "" for admins.
+func scopeOwner(c echo.Context) string {
+	if key := apiKeyOf(c); key != nil && !key.Admin {
+		return key.Owner
+	}
+	return ""
+}
+
+func canModify(c echo.Context, url store.URL) bool {
+	owner := scopeOwner(c)
+	return owner == "" || owner == url.Owner
+}
+
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	auth := r.Header.Get(echo.HeaderAuthorization)
+	if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+func hashAPIKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// validateNewKey checks a POST /keys request. The TTL overrides are in
+// minutes, and the key's default lifetime must be one its maximum allows.
+// A max of 0 inherits MAXTTL and a negative max lifts the limit.
+func validateNewKey(owner string, defaultTTL, maxTTL int) error {
+	var errs validationError
+	if owner == "" {
+		errs.add("owner", "is required")
+	}
+	limit := int(config.AppConfig.MaxTTL.Minutes())
+	if maxTTL != 0 {
+		limit = maxTTL
+	}
+	switch {
+	case defaultTTL < 0:
+		errs.add("default_ttl", "must not be negative")
+	case limit > 0 && defaultTTL > limit:
+		errs.add("default_ttl", fmt.Sprintf("must not exceed the key's maximum of %d minutes", limit))
+	}
+	return errs.orNil()
+}
+
+func (s *Server) createAPIKey(c echo.Context) error {
+	var req struct {
+		Owner      string `json:"owner"`
+		Admin      bool   `json:"admin"`
+		RateLimit  int    `json:"rate_limit"`
+		DefaultTTL int    `json:"default_ttl"`
+		MaxTTL     int    `json:"max_ttl"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid input"})
+	}
+	if err := validateNewKey(strings.TrimSpace(req.Owner), req.DefaultTTL, req.MaxTTL); err != nil {
+		return invalidInput(c, err.(validationError))
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "could not generate key"})
+	}
+	raw := base64.RawURLEncoding.EncodeToString(b)
+
+	key := store.APIKey{
+		Hash:      hashAPIKey(raw),
+		Owner:     strings.TrimSpace(req.Owner),
+		Admin:     req.Admin,
+		RateLimit: req.RateLimit,
+		CreatedAt: time.Now(),
+
+		DefaultTTL: req.DefaultTTL,
+		MaxTTL:     req.MaxTTL,
+	}
+	ctx, cancel := opContext(c)
+	defer cancel()
+	if err := s.Links.CreateAPIKey(ctx, key); err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "DB insert failed"})
+	}
+
+	return c.JSON(http.StatusCreated, echo.Map{"key": raw, "owner": key.Owner, "admin": key.Admin})
+}
@@ -0,0 +1,259 @@
+package api
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"url-shortner/internal/config"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+type batchRow struct {
+	req shortenRequest
+	err error
+}
+
+type batchResult struct {
+	Index    int          `json:"index"`
+	ID       string       `json:"id,omitempty"`
+	ShortURL string       `json:"short_url,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Fields   []fieldError `json:"fields,omitempty"`
+}
+
+var (
+	errBatchTooLarge = errors.New("batch too large")
+	errNotArray      = errors.New("body must be a JSON array of shorten requests")
+)
+
+func (s *Server) shortenBatch(c echo.Context) error {
+	rows, err := parseBatch(c)
+	if errors.Is(err, errBatchTooLarge) {
+		return c.JSON(http.StatusRequestEntityTooLarge, echo.Map{
+			"error": fmt.Sprintf("batch exceeds %d rows", config.AppConfig.BatchMaxSize),
+		})
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+	if len(rows) == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "empty batch"})
+	}
+
+	results := make([]batchResult, len(rows))
+	urls := make([]store.URL, 0, len(rows))
+	// rowOf maps an index in urls back to its input row.
+	rowOf := make([]int, 0, len(rows))
+	policy := policyFor(c)
+
+	for i, row := range rows {
+		results[i].Index = i
+		if row.err != nil {
+			results[i].Error = row.err.Error()
+			continue
+		}
+		if row.req.Password != "" {
+			// Every password costs a bcrypt hash, far too slow to do for a
+			// whole batch in one request.
+			results[i].Error = "invalid input"
+			results[i].Fields = validationError{{Field: "password", Message: "is not supported in batches, use POST /shorten"}}
+			continue
+		}
+		if err := validateShorten(&row.req, c.Request().Host, policy); err != nil {
+			results[i].Error = "invalid input"
+			results[i].Fields = err.(validationError)
+			continue
+		}
+		url := newURL(row.req)
+		url.Owner = ownerOf(c)
+		urls = append(urls, url)
+		rowOf = append(rowOf, i)
+	}
+
+	errs := s.insertLinks(c, urls)
+
+	var entries []store.CacheEntry
+	for i, url := range urls {
+		row := rowOf[i]
+		switch {
+		case errs[i] == store.ErrDuplicate && url.Alias:
+			results[row].Error = "alias already taken"
+			continue
+		case errs[i] == store.ErrDuplicate, errs[i] == errGenerateID:
+			results[row].Error = "could not generate a unique ID"
+			continue
+		case errs[i] != nil:
+			results[row].Error = "DB insert failed"
+			continue
+		}
+		results[row].ID = url.ID
+		results[row].ShortURL = shortLink(c, url.ID)
+		if entry, ok, err := cacheEntry(url); err == nil && ok {
+			entries = append(entries, entry)
+		}
+	}
+	ctx, cancel := detachedContext(c)
+	defer cancel()
+	if err := s.Cache.SetMany(ctx, entries); err != nil {
+		log.Printf("warming cache for batch failed: %v", err)
+	}
+
+	created := 0
+	for _, r := range results {
+		if r.Error == "" {
+			created++
+		}
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"created": created,
+		"failed":  len(results) - created,
+		"results": results,
+	})
+}
+
+// parseBatch reads the request body as a JSON array, NDJSON or CSV depending
+// on its Content-Type. Rows that fail to parse are returned with err set so
+// they are reported individually instead of failing the whole batch.
+func parseBatch(c echo.Context) ([]batchRow, error) {
+	req := c.Request()
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+	if err != nil {
+		return nil, errors.New("missing or invalid Content-Type")
+	}
+
+	switch mediaType {
+	case echo.MIMEApplicationJSON:
+		return parseJSONArray(req.Body)
+	case "application/x-ndjson", "application/jsonl":
+		return parseNDJSON(req.Body)
+	case "text/csv":
+		return parseCSV(req.Body)
+	case echo.MIMEMultipartForm:
+		fh, err := c.FormFile("file")
+		if err != nil {
+			return nil, errors.New("multipart upload must contain a \"file\" field")
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseCSV(f)
+	default:
+		return nil, fmt.Errorf("unsupported Content-Type %q", mediaType)
+	}
+}
+
+// parseJSONArray decodes the array one element at a time, so an oversized
+// batch is rejected once BATCHMAXSIZE is passed instead of being read whole.
+// Only malformed JSON fails the whole batch; an element of the wrong shape is
+// reported as that row's error, like a bad NDJSON line.
+func parseJSONArray(r io.Reader) ([]batchRow, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, errNotArray
+	}
+	var rows []batchRow
+	for dec.More() {
+		if len(rows) == config.AppConfig.BatchMaxSize {
+			return nil, errBatchTooLarge
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, errNotArray
+		}
+		var row batchRow
+		if err := json.Unmarshal(raw, &row.req); err != nil {
+			row.err = errors.New("invalid JSON")
+		}
+		rows = append(rows, row)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, errNotArray
+	}
+	return rows, nil
+}
+
+func parseNDJSON(r io.Reader) ([]batchRow, error) {
+	var rows []batchRow
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if len(rows) == config.AppConfig.BatchMaxSize {
+			return nil, errBatchTooLarge
+		}
+		var row batchRow
+		if err := json.Unmarshal([]byte(line), &row.req); err != nil {
+			row.err = errors.New("invalid JSON")
+		}
+		rows = append(rows, row)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// parseCSV accepts url,expire,alias,tags rows, with tags separated by
+// spaces. A header row is optional; when present its column names decide
+// the column order.
+func parseCSV(r io.Reader) ([]batchRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	cols := map[string]int{"url": 0, "expire": 1, "alias": 2, "tags": 3}
+	var rows []batchRow
+	for first := true; ; first = false {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		if first && len(rec) > 0 && strings.EqualFold(strings.TrimSpace(rec[0]), "url") {
+			cols = map[string]int{}
+			for i, name := range rec {
+				cols[strings.ToLower(strings.TrimSpace(name))] = i
+			}
+			continue
+		}
+		if len(rows) == config.AppConfig.BatchMaxSize {
+			return nil, errBatchTooLarge
+		}
+
+		field := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		var row batchRow
+		row.req.URL = field("url")
+		row.req.Alias = field("alias")
+		row.req.Tags = strings.Fields(field("tags"))
+		if v := field("expire"); v != "" {
+			if expire, err := strconv.Atoi(v); err != nil {
+				row.err = errors.New("expire must be an integer number of minutes")
+			} else {
+				row.req.Expire = &expire
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"url-shortner/internal/config"
+	"url-shortner/internal/metrics"
+	"url-shortner/internal/store"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func cacheKey(id string) string {
+	return "short:" + id
+}
+
+// cacheEntry encodes the whole document as BSON so per-link settings are
+// available on a cache hit. Entries live as long as the link, but never
+// longer than CACHETTL. ok is false for links that have already expired,
+// and for links that are not live yet, so their target never sits in Redis
+// before it may be served.
+func cacheEntry(url store.URL) (entry store.CacheEntry, ok bool, err error) {
+	ttl, expires := url.Remaining()
+	if expires && ttl <= 0 || url.Pending() {
+		return entry, false, nil
+	}
+	if limit := config.AppConfig.CacheTTL; limit > 0 && (!expires || ttl > limit) {
+		ttl = limit
+	}
+	b, err := bson.Marshal(url)
+	if err != nil {
+		return entry, false, err
+	}
+	return store.CacheEntry{Key: cacheKey(url.ID), Value: b, TTL: ttl}, true, nil
+}
+
+// cacheURL replaces any cached copy of url.
+func (s *Server) cacheURL(ctx context.Context, url store.URL) error {
+	entry, ok, err := cacheEntry(url)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return s.Cache.Del(ctx, cacheKey(url.ID))
+	}
+	return s.Cache.Set(ctx, entry.Key, entry.Value, entry.TTL)
+}
+
+// cachedURL returns store.ErrCacheMiss on a miss. Entries that do not
+// decode, such as plain-string values written by older releases, are also
+// reported as a miss so they get rewritten.
+func (s *Server) cachedURL(ctx context.Context, id string) (store.URL, error) {
+	var url store.URL
+	b, err := s.Cache.Get(ctx, cacheKey(id))
+	switch {
+	case err == store.ErrCacheMiss:
+		metrics.CacheLookup(metrics.CacheMiss)
+		return url, err
+	case err == store.ErrCacheUnavailable:
+		metrics.CacheLookup(metrics.CacheSkipped)
+		return url, err
+	case err != nil:
+		metrics.CacheLookup(metrics.CacheError)
+		return url, err
+	}
+	if err := bson.Unmarshal(b, &url); err != nil {
+		metrics.CacheLookup(metrics.CacheMiss)
+		return url, store.ErrCacheMiss
+	}
+	metrics.CacheLookup(metrics.CacheHit)
+	return url, nil
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"url-shortner/internal/metrics"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+// linkFailure is why a short link cannot be followed, worded for API
+// clients and for people, with the redirect outcome it is counted as.
+type linkFailure struct {
+	code    int
+	msg     string // the JSON "error"
+	reason  string // the JSON "reason", if any
+	title   string
+	detail  string
+	outcome string
+}
+
+var (
+	failNotFound = linkFailure{
+		code:   http.StatusNotFound,
+		msg:    "URL not found",
+		title:  "Link not found",
+		detail: "There is no link at this address. Check that it was copied completely.",
+
+		outcome: metrics.RedirectNotFound,
+	}
+	failExpired = linkFailure{
+		code:   http.StatusGone,
+		msg:    "URL expired",
+		reason: "expired",
+		title:  "This link has expired",
+		detail: "It was only valid for a limited time and no longer leads anywhere.",
+
+		outcome: metrics.RedirectExpired,
+	}
+	failDeleted = linkFailure{
+		code:   http.StatusGone,
+		msg:    "URL deleted",
+		reason: "deleted",
+		title:  "This link was removed",
+		detail: "Its owner deleted it, so it no longer leads anywhere.",
+
+		outcome: metrics.RedirectDeleted,
+	}
+	failExhausted = linkFailure{
+		code:   http.StatusGone,
+		msg:    "link has reached its click limit",
+		reason: "exhausted",
+		title:  "This link has been used up",
+		detail: "It could only be followed a limited number of times.",
+
+		outcome: metrics.RedirectExhausted,
+	}
+	failLookup = linkFailure{
+		code:   http.StatusInternalServerError,
+		msg:    "DB lookup failed",
+		title:  "Something went wrong",
+		detail: "The link could not be looked up. Please try again in a moment.",
+
+		outcome: metrics.RedirectError,
+	}
+	failUncounted = linkFailure{
+		code:   http.StatusServiceUnavailable,
+		msg:    "could not count click",
+		title:  "Something went wrong",
+		detail: "The link could not be followed. Please try again in a moment.",
+
+		outcome: metrics.RedirectError,
+	}
+)
+
+// failureFor maps a findURL or consumeClick error to its failure. Other
+// errors are lookup failures.
+func failureFor(err error) linkFailure {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return failNotFound
+	case errors.Is(err, errExpired):
+		return failExpired
+	case errors.Is(err, store.ErrDeleted):
+		return failDeleted
+	case errors.Is(err, store.ErrLimitReached):
+		return failExhausted
+	}
+	return failLookup
+}
+
+// errorPage is the data of templates/error.html.
+type errorPage struct {
+	Code   int
+	Title  string
+	Detail string
+}
+
+// respondFailure answers with an HTML error page when the client prefers
+// HTML, as browsers do, and with JSON otherwise.
+func respondFailure(c echo.Context, f linkFailure) error {
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	if wantsHTML(c.Request()) {
+		return renderPage(c, f.code, "error.html", errorPage{Code: f.code, Title: f.title, Detail: f.detail})
+	}
+	body := echo.Map{"error": f.msg}
+	if f.reason != "" {
+		body["reason"] = f.reason
+	}
+	return c.JSON(f.code, body)
+}
+
+// handleError replaces echo's default error handler so that errors raised
+// outside the handlers, such as unknown routes, are negotiated like the
+// handlers' own and use the same "error" key.
+func handleError(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	code, msg := http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		code = he.Code
+		if s, ok := he.Message.(string); ok {
+			msg = s
+		} else {
+			msg = http.StatusText(code)
+		}
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(code)
+	} else if code == http.StatusNotFound {
+		err = respondFailure(c, failNotFound)
+	} else {
+		err = respondFailure(c, linkFailure{code: code, msg: msg, title: http.StatusText(code), detail: "The request could not be completed."})
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
+
+// wantsHTML reports whether the Accept header ranks HTML above JSON. A
+// wildcard alone counts for JSON, so tools like curl keep getting JSON.
+func wantsHTML(r *http.Request) bool {
+	var html, json, any float64
+	for _, part := range strings.Split(r.Header.Get(echo.HeaderAccept), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case echo.MIMETextHTML, "application/xhtml+xml":
+			html = max(html, q)
+		case echo.MIMEApplicationJSON:
+			json = max(json, q)
+		case "*/*":
+			any = max(any, q)
+		}
+	}
+	if json == 0 {
+		json = any
+	}
+	return html > 0 && html > json
+}
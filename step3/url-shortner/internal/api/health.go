@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+	"url-shortner/internal/config"
+
+	"github.com/labstack/echo/v4"
+)
+
+type dependencyStatus struct {
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// isProbe keeps Kubernetes probes out of the traces.
+func isProbe(c echo.Context) bool {
+	switch c.Request().URL.Path {
+	case "/healthz", "/livez", "/readyz":
+		return true
+	}
+	return false
+}
+
+// livez only reports that the process is serving HTTP. It must not check
+// dependencies, or an outage would make Kubernetes restart every pod.
+func livez(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
+}
+
+// readyz pings MongoDB and Redis concurrently. MongoDB is required; without
+// Redis the service is degraded but ready, because lookups fall back to
+// MongoDB and the rate limiter fails open.
+func (s *Server) readyz(c echo.Context) error {
+	if s.draining.Load() {
+		return c.JSON(http.StatusServiceUnavailable, echo.Map{"status": "draining"})
+	}
+
+	var mongo, redis dependencyStatus
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		mongo = ping(c.Request().Context(), s.Links.Ping)
+	}()
+	go func() {
+		defer wg.Done()
+		redis = ping(c.Request().Context(), s.Cache.Ping)
+	}()
+	wg.Wait()
+
+	status, code := "ok", http.StatusOK
+	switch {
+	case mongo.Status != "up":
+		status, code = "unavailable", http.StatusServiceUnavailable
+	case redis.Status != "up":
+		status = "degraded"
+	}
+	return c.JSON(code, echo.Map{
+		"status": status,
+		"checks": echo.Map{"mongo": mongo, "redis": redis},
+	})
+}
+
+func ping(ctx context.Context, fn func(context.Context) error) dependencyStatus {
+	if timeout := config.AppConfig.HealthTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	err := fn(ctx)
+	res := dependencyStatus{Status: "up", LatencyMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		res.Status, res.Error = "down", err.Error()
+	}
+	return res
+}
+
+// Drain makes /readyz fail so the pod is taken out of rotation while it
+// keeps serving the requests that are still routed to it.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
@@ -1,22 +1,109 @@
 package api
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"errors"
+	"regexp"
+	"strings"
 	"time"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+type shortenRequest struct {
+	URL    string `json:"url"`
+	Expire *int   `json:"expire"` // in minutes, 0 for never
+	Alias  string `json:"alias"`
+
+	Redirect     int    `json:"redirect"` // 301, 302, 307 or 308
+	Interstitial bool   `json:"interstitial"`
+	Password     string `json:"password"`
+	MaxClicks    int    `json:"max_clicks"`  // 0 for unlimited
+	ActivateAt   string `json:"activate_at"` // RFC 3339
+	FallbackURL  string `json:"fallback_url"`
+
+	Tags []string `json:"tags"`
+
+	ttl          time.Duration // resolved by validateShorten
+	passwordHash string        // derived by validateShorten
+	activateAt   *time.Time    // parsed by validateShorten
+}
+
+// patchRequest fields are pointers so omitted fields are left unchanged.
+type patchRequest struct {
+	URL      *string `json:"url"`
+	Expire   *int    `json:"expire"` // in minutes from now, 0 for never
+	Redirect *int    `json:"redirect"`
+	Version  *int    `json:"version"`
+
+	Interstitial *bool   `json:"interstitial"`
+	Password     *string `json:"password"`     // "" removes the password
+	MaxClicks    *int    `json:"max_clicks"`   // 0 removes the limit
+	ActivateAt   *string `json:"activate_at"`  // "" makes the link live now
+	FallbackURL  *string `json:"fallback_url"` // "" removes the fallback
+
+	Tags *[]string `json:"tags"` // [] removes the tags
+
+	passwordHash *string    // derived by validatePatch
+	activateAt   *time.Time // parsed by validatePatch
+}
+
+// reservedAliases are path segments owned by the router itself.
+var reservedAliases = map[string]struct{}{
+	"healthz": {},
+	"keys":    {},
+	"links":   {},
+	"livez":   {},
+	"readyz":  {},
+	"shorten": {},
+}
+
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{2,63}$`)
+
+const maxTags = 10
+
+// tagPattern applies after tags are lowercased.
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+var (
+	errAliasFormat   = errors.New("alias must be 3-64 characters of letters, digits, '-' or '_'")
+	errAliasReserved = errors.New("alias is reserved")
+	errGenerateID    = errors.New("could not generate ID")
 )
 
-type URL struct {
-	ID        string    `bson:"_id" json:"id"`
-	Original  string    `bson:"original_url" json:"original_url"`
-	CreatedAt time.Time `bson:"created_at" json:"created_at"`
-	ExpireAt  time.Time `bson:"expire_at" json:"expire_at"`
+func validateAlias(alias string) error {
+	if !aliasPattern.MatchString(alias) {
+		return errAliasFormat
+	}
+	if _, ok := reservedAliases[strings.ToLower(alias)]; ok {
+		return errAliasReserved
+	}
+	return nil
 }
 
-func generateID() (string, error) {
-	b := make([]byte, 6)
-	if _, err := rand.Read(b); err != nil {
-		return "", err
+// newURL builds the document to insert for an already validated req. Links
+// without an alias get their ID when they are inserted.
+func newURL(req shortenRequest) store.URL {
+	return store.URL{
+		ID:        req.Alias,
+		Original:  req.URL,
+		CreatedAt: time.Now(),
+		ExpireAt:  expiryFor(req.ttl),
+		Alias:     req.Alias != "",
+		Version:   1,
+
+		RedirectCode: req.Redirect,
+		Interstitial: req.Interstitial,
+		PasswordHash: req.passwordHash,
+		MaxClicks:    req.MaxClicks,
+		ActivateAt:   req.activateAt,
+		FallbackURL:  req.FallbackURL,
+
+		Tags:   req.Tags,
+		Domain: store.TargetDomain(req.URL),
 	}
-	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+func shortLink(c echo.Context, id string) string {
+	return c.Scheme() + "://" + c.Request().Host + "/" + id
 }
@@ -2,100 +2,352 @@ package api
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+	"url-shortner/internal/config"
+	"url-shortner/internal/idgen"
+	"url-shortner/internal/metrics"
+	"url-shortner/internal/store"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"github.com/redis/go-redis/v9"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+	"golang.org/x/sync/singleflight"
 )
 
-var (
-	Ctx         = context.Background()
-	RedisClient *redis.Client
-	MongoCol    *mongo.Collection
-)
+// Server holds the dependencies shared by all handlers. Filter is optional;
+// without it every cache miss for a well-formed ID reaches the LinkStore.
+// IDs defaults to random base62 IDs.
+type Server struct {
+	Links  store.LinkStore
+	Cache  store.Cache
+	Filter store.Filter
+	IDs    idgen.Generator
+
+	clicks   chan store.Click
+	lookups  singleflight.Group
+	draining atomic.Bool
+}
+
+func NewServer(links store.LinkStore, cache store.Cache) *Server {
+	return &Server{
+		Links:  links,
+		Cache:  cache,
+		IDs:    idgen.NewRandom(idgen.Base62, idgen.DefaultLength),
+		clicks: make(chan store.Click, clickBufferSize),
+	}
+}
+
+// opContext bounds a single store call by OPTIMEOUT. It derives from the
+// request context, so work for a client that has gone away is cancelled.
+func opContext(c echo.Context) (context.Context, context.CancelFunc) {
+	return withOpTimeout(c.Request().Context())
+}
+
+// detachedContext is for follow-up writes, such as cache invalidation, that
+// must still happen once the primary write has succeeded even if the client
+// disconnects.
+func detachedContext(c echo.Context) (context.Context, context.CancelFunc) {
+	return withOpTimeout(context.WithoutCancel(c.Request().Context()))
+}
 
-func SetupRouter() *echo.Echo {
+func withOpTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := config.AppConfig.OpTimeout; timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (s *Server) SetupRouter() *echo.Echo {
 	e := echo.New()
+	e.HTTPErrorHandler = handleError
+	e.IPExtractor = ipExtractor(config.AppConfig.TrustedProxies)
 
+	e.Use(otelecho.Middleware(config.AppConfig.ServiceName, otelecho.WithSkipper(isProbe)))
+	e.Use(metrics.Middleware)
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
-	e.GET("/healthz", health)
+	e.GET("/healthz", livez)
+	e.GET("/livez", livez)
+	e.GET("/readyz", s.readyz)
 
-	e.POST("/shorten", shortenURL)
-	e.GET("/:hsh", resolveURL)
-	e.DELETE("/:hsh", deleteURL)
+	e.POST("/keys", s.createAPIKey, s.authenticate, requireAdmin)
 
-	return e
-}
+	shortenLimit := s.rateLimit("shorten", config.AppConfig.RateLimitShorten)
+	redirectLimit := s.rateLimit("redirect", config.AppConfig.RateLimitRedirect)
 
-func health(c echo.Context) error {
-	return c.String(http.StatusOK, "ok")
+	e.POST("/shorten", s.shortenURL, s.authenticate, shortenLimit)
+	e.POST("/shorten/batch", s.shortenBatch, s.authenticate, shortenLimit, middleware.BodyLimit(config.AppConfig.BatchMaxBody))
+	e.GET("/links", s.listLinks, s.authenticate, requireAPIKey)
+	e.GET("/:hsh", s.resolveURL, redirectLimit)
+	e.HEAD("/:hsh", s.resolveURL, redirectLimit)
+	e.POST("/:hsh", s.unlockURL, redirectLimit)
+	e.GET("/:hsh/stats", s.linkStats)
+	e.GET("/:hsh/qr", s.linkQR, redirectLimit)
+	e.PATCH("/:hsh", s.updateURL, s.authenticate, requireAPIKey)
+	e.DELETE("/:hsh", s.deleteURL, s.authenticate, requireAPIKey)
+
+	return e
 }
 
-func shortenURL(c echo.Context) error {
-	type Request struct {
-		URL    string `json:"url"`
-		Expire int    `json:"expire"` // in minutes
-	}
-	var req Request
+func (s *Server) shortenURL(c echo.Context) error {
+	var req shortenRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid input"})
 	}
+	if err := validateShorten(&req, c.Request().Host, policyFor(c)); err != nil {
+		return invalidInput(c, err.(validationError))
+	}
 
-	id, err := generateID()
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "could not generate ID"})
+	url := newURL(req)
+	url.Owner = ownerOf(c)
+
+	urls := []store.URL{url}
+	err := s.insertLinks(c, urls)[0]
+	url = urls[0]
+	switch {
+	case err == store.ErrDuplicate && url.Alias:
+		return c.JSON(http.StatusConflict, echo.Map{"error": "alias already taken"})
+	case err == store.ErrDuplicate, err == errGenerateID:
+		return c.JSON(http.StatusServiceUnavailable, echo.Map{"error": "could not generate a unique ID"})
+	case err != nil:
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "DB insert failed"})
+	}
+
+	ctx, cancel := detachedContext(c)
+	defer cancel()
+	s.cacheURL(ctx, url)
+
+	return c.JSON(http.StatusOK, echo.Map{"short_url": shortLink(c, url.ID)})
+}
+
+// findURL returns the link from Redis or, on a miss, from the LinkStore.
+// hit reports whether Redis answered. Like lookupURL it returns
+// store.ErrNotFound, errExpired or store.ErrDeleted for links that cannot
+// be served.
+func (s *Server) findURL(c echo.Context, id string) (url store.URL, hit bool, err error) {
+	ctx, cancel := opContext(c)
+	url, err = s.cachedURL(ctx, id)
+	cancel()
+	if err == nil {
+		return url, true, nil
+	}
+	// Serve from MongoDB when Redis is down rather than failing the
+	// request; /readyz reports this as degraded. While the breaker is open
+	// the cache lookup is not even attempted.
+	if err != store.ErrCacheMiss && err != store.ErrCacheUnavailable {
+		log.Printf("cache lookup for %s failed, falling back to MongoDB: %v", id, err)
 	}
+	url, err = s.lookupURL(c, id)
+	return url, false, err
+}
 
-	expireTime := time.Now().Add(time.Duration(req.Expire) * time.Minute)
-	url := URL{
-		ID:        id,
-		Original:  req.URL,
-		CreatedAt: time.Now(),
-		ExpireAt:  expireTime,
+// linkParam returns the link ID from the path and whether the preview page
+// was asked for with a trailing "+" or ?preview=1.
+func linkParam(c echo.Context) (id string, preview bool) {
+	id = c.Param("hsh")
+	preview, _ = strconv.ParseBool(c.QueryParam("preview"))
+	if trimmed, ok := strings.CutSuffix(id, "+"); ok {
+		id, preview = trimmed, true
 	}
+	return id, preview
+}
 
-	_, err = MongoCol.InsertOne(Ctx, url)
+// resolveURL redirects to the link's target. A trailing "+" or ?preview=1
+// asks for the preview page instead, and links with Interstitial always get
+// it. Forced interstitials count as clicks; asking for a preview does not,
+// except on click-limited links, which answer 410 Gone to every request,
+// HEAD included, once their clicks are used up. HEAD does not use a click,
+// so for those links it answers 200 without revealing the target.
+// Protected links only get a password form, which unlockURL handles. Links
+// that are not live yet get notActive whatever was asked for.
+func (s *Server) resolveURL(c echo.Context) error {
+	id, preview := linkParam(c)
+	url, hit, err := s.findURL(c, id)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "DB insert failed"})
+		return failRedirect(c, failureFor(err))
+	}
+	outcome := metrics.RedirectMiss
+	if hit {
+		outcome = metrics.RedirectHit
 	}
 
-	RedisClient.Set(Ctx, "short:"+id, req.URL, time.Duration(req.Expire)*time.Minute)
+	if url.Pending() {
+		metrics.Redirect(metrics.RedirectNotActive)
+		return notActive(c, url)
+	}
+	if url.Protected() {
+		metrics.Redirect(outcome)
+		return renderPasswordForm(c, http.StatusOK, url, "")
+	}
+	setRedirectCaching(c, url)
+	if url.MaxClicks > 0 {
+		// Every click has to reach us to be counted.
+		c.Response().Header().Set("Cache-Control", "no-store")
+	}
+	switch {
+	case c.Request().Method == http.MethodHead:
+		err = s.checkClicksLeft(c, url)
+	case !preview, url.MaxClicks > 0:
+		// Previews of click-limited links show the target, so they use a
+		// click like the redirect would.
+		err = s.consumeClick(c, url)
+		if err == nil {
+			s.recordClick(c, id)
+		}
+	}
+	switch {
+	case err == store.ErrLimitReached:
+		return failRedirect(c, failExhausted)
+	case err != nil:
+		return failRedirect(c, failUncounted)
+	}
+	metrics.Redirect(outcome)
+	if c.Request().Method == http.MethodHead && url.MaxClicks > 0 {
+		return c.NoContent(http.StatusOK)
+	}
+	if preview || url.Interstitial {
+		return renderPreview(c, url)
+	}
+	return c.Redirect(redirectCode(url), url.Original)
+}
 
-	return c.JSON(http.StatusOK, echo.Map{"short_url": c.Scheme() + "://" + c.Request().Host + "/" + id})
+// failRedirect counts a redirect that failed and answers with its error.
+func failRedirect(c echo.Context, f linkFailure) error {
+	metrics.Redirect(f.outcome)
+	return respondFailure(c, f)
 }
 
-func resolveURL(c echo.Context) error {
-	id := c.Param("hsh")
-	key := "short:" + id
-
-	original, err := RedisClient.Get(Ctx, key).Result()
-	if err == redis.Nil {
-		var result URL
-		err := MongoCol.FindOne(Ctx, bson.M{"_id": id}).Decode(&result)
-		if err != nil {
-			return c.JSON(http.StatusNotFound, echo.Map{"error": "URL not found"})
-		}
-		RedisClient.Set(Ctx, key, result.Original, time.Until(result.ExpireAt))
-		original = result.Original
-	} else if err != nil {
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Redis error"})
+func redirectCode(url store.URL) int {
+	if url.RedirectCode != 0 {
+		return url.RedirectCode
+	}
+	if code := config.AppConfig.DefaultRedirectCode; validRedirectCode(code) {
+		return code
 	}
+	return http.StatusFound
+}
 
-	return c.Redirect(http.StatusMovedPermanently, original)
+// setRedirectCaching lets clients cache the redirect, or the link's QR
+// code, for as long as the link lives, capped by REDIRECTMAXAGE so edits and
+// deletes are picked up.
+func setRedirectCaching(c echo.Context, url store.URL) {
+	limit := config.AppConfig.RedirectMaxAge
+	maxAge, expires := url.Remaining()
+	if !expires || (limit > 0 && maxAge > limit) {
+		maxAge = limit
+	}
+	if maxAge < time.Second {
+		c.Response().Header().Set("Cache-Control", "no-cache")
+		return
+	}
+	c.Response().Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
 }
 
-func deleteURL(c echo.Context) error {
+func (s *Server) deleteURL(c echo.Context) error {
 	id := c.Param("hsh")
-	_, err := MongoCol.DeleteOne(Ctx, bson.M{"_id": id})
+	ctx, cancel := opContext(c)
+	err := s.Links.Delete(ctx, id, scopeOwner(c))
+	cancel()
+	if err == store.ErrNotFound {
+		return s.notOwnedOrMissing(c, id)
+	}
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "DB delete failed"})
 	}
-	RedisClient.Del(Ctx, "short:"+id)
+	ctx, cancel = detachedContext(c)
+	defer cancel()
+	s.Cache.Del(ctx, cacheKey(id), usageKey(id), negativeKey(id))
 	return c.JSON(http.StatusOK, echo.Map{"message": "URL deleted"})
 }
+
+// updateURL applies a partial update guarded by the link's version: the
+// write only succeeds if nobody changed the link since the client read it.
+func (s *Server) updateURL(c echo.Context) error {
+	id := c.Param("hsh")
+
+	var req patchRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid input"})
+	}
+	if err := validatePatch(&req, c.Request().Host, policyFor(c)); err != nil {
+		return invalidInput(c, err.(validationError))
+	}
+
+	patch := store.LinkPatch{
+		Original:     req.URL,
+		RedirectCode: req.Redirect,
+		Interstitial: req.Interstitial,
+		PasswordHash: req.passwordHash,
+		MaxClicks:    req.MaxClicks,
+		FallbackURL:  req.FallbackURL,
+		Tags:         req.Tags,
+	}
+	if req.ActivateAt != nil {
+		patch.SetActivateAt = true
+		patch.ActivateAt = req.activateAt
+	}
+	if req.Expire != nil {
+		patch.SetExpireAt = true
+		patch.ExpireAt = expiryFor(time.Duration(*req.Expire) * time.Minute)
+	}
+	if patch.SetActivateAt || patch.SetExpireAt {
+		// The schedule depends on the fields the patch leaves alone. The
+		// version guard makes sure Update applies to the link checked here;
+		// other outcomes are left to Update to report.
+		ctx, cancel := opContext(c)
+		current, err := s.Links.Get(ctx, id)
+		cancel()
+		if err == nil && current.Version == *req.Version && canModify(c, current) {
+			if err := checkSchedule(current, patch); err != nil {
+				return invalidInput(c, err.(validationError))
+			}
+		}
+	}
+
+	ctx, cancel := opContext(c)
+	url, err := s.Links.Update(ctx, id, *req.Version, scopeOwner(c), patch)
+	cancel()
+	if err == store.ErrNotFound {
+		ctx, cancel := opContext(c)
+		current, err := s.Links.Get(ctx, id)
+		cancel()
+		if err != nil || !canModify(c, current) {
+			return s.notOwnedOrMissing(c, id)
+		}
+		return c.JSON(http.StatusConflict, echo.Map{"error": "version conflict", "version": current.Version})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "DB update failed"})
+	}
+
+	ctx, cancel = detachedContext(c)
+	defer cancel()
+	if err := s.cacheURL(ctx, url); err != nil {
+		s.Cache.Del(ctx, cacheKey(id))
+	}
+	// A patched expiry can bring back a link remembered as expired.
+	s.Cache.Del(ctx, negativeKey(id))
+	return c.JSON(http.StatusOK, url)
+}
+
+// notOwnedOrMissing explains why an owner-scoped write matched nothing.
+func (s *Server) notOwnedOrMissing(c echo.Context, id string) error {
+	ctx, cancel := opContext(c)
+	defer cancel()
+	_, err := s.Links.Get(ctx, id)
+	if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrDeleted) {
+		return c.JSON(http.StatusNotFound, echo.Map{"error": "URL not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "DB lookup failed"})
+	}
+	return c.JSON(http.StatusForbidden, echo.Map{"error": "link is owned by another API key"})
+}
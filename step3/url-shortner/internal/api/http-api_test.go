@@ -0,0 +1,1242 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"url-shortner/internal/config"
+	"url-shortner/internal/metrics"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const testAdminKey = "test-admin-key"
+
+func TestMain(m *testing.M) {
+	config.LoadConfig()
+	config.AppConfig.AdminAPIKey = testAdminKey
+	os.Exit(m.Run())
+}
+
+func newTestServer(t *testing.T) (*Server, *echo.Echo) {
+	t.Helper()
+	srv := NewServer(store.NewMemoryStore(), store.NewMemoryCache())
+	return srv, srv.SetupRouter()
+}
+
+func do(e *echo.Echo, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	return doFrom(e, "192.0.2.1:1234", method, path, body, headers...)
+}
+
+// doFrom is do for a client connecting from addr.
+func doFrom(e *echo.Echo, addr, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Host = "sho.rt"
+	req.RemoteAddr = addr
+	if body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	return body
+}
+
+func createKey(t *testing.T, srv *Server, owner string) string {
+	t.Helper()
+	raw := "key-" + owner
+	err := srv.Links.CreateAPIKey(context.Background(), store.APIKey{Hash: hashAPIKey(raw), Owner: owner, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestShortenAndResolve(t *testing.T) {
+	_, e := newTestServer(t)
+
+	rec := do(e, http.MethodPost, "/shorten", `{"url":"HTTPS://Example.com:443/a","expire":10}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("shorten: got %d: %s", rec.Code, rec.Body)
+	}
+	shortURL := decode(t, rec)["short_url"].(string)
+	if !strings.HasPrefix(shortURL, "http://sho.rt/") {
+		t.Fatalf("unexpected short_url %q", shortURL)
+	}
+
+	rec = do(e, http.MethodGet, strings.TrimPrefix(shortURL, "http://sho.rt"), "")
+	if rec.Code != http.StatusFound {
+		t.Fatalf("resolve: got %d", rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != "https://example.com/a" {
+		t.Errorf("Location = %q", loc)
+	}
+	if cc := rec.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "public, max-age=") {
+		t.Errorf("Cache-Control = %q", cc)
+	}
+}
+
+func TestResolveFallsBackToStore(t *testing.T) {
+	srv, e := newTestServer(t)
+
+	rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"docs","redirect":308}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("shorten: got %d: %s", rec.Code, rec.Body)
+	}
+	srv.Cache.Del(context.Background(), cacheKey("docs"))
+
+	rec = do(e, http.MethodGet, "/docs", "")
+	if rec.Code != http.StatusPermanentRedirect {
+		t.Fatalf("resolve: got %d", rec.Code)
+	}
+	if _, err := srv.Cache.Get(context.Background(), cacheKey("docs")); err != nil {
+		t.Errorf("link was not re-cached: %v", err)
+	}
+}
+
+func TestResolveUnknown(t *testing.T) {
+	_, e := newTestServer(t)
+	if rec := do(e, http.MethodGet, "/missing", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("got %d", rec.Code)
+	}
+}
+
+func TestShortenAlias(t *testing.T) {
+	_, e := newTestServer(t)
+
+	if rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"q3-report"}`); rec.Code != http.StatusOK {
+		t.Fatalf("first alias: got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.org","alias":"q3-report"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("duplicate alias: got %d", rec.Code)
+	}
+	if rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.org","alias":"healthz"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("reserved alias: got %d", rec.Code)
+	}
+}
+
+func TestShortenValidation(t *testing.T) {
+	_, e := newTestServer(t)
+
+	rec := do(e, http.MethodPost, "/shorten", `{"url":"javascript:alert(1)","alias":"x","expire":-1}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got %d", rec.Code)
+	}
+	fields := decode(t, rec)["fields"].([]interface{})
+	if len(fields) != 3 {
+		t.Errorf("expected 3 field errors, got %v", fields)
+	}
+
+	rec = do(e, http.MethodPost, "/shorten", `{"url":"http://sho.rt/loop"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("self-referencing URL: got %d", rec.Code)
+	}
+}
+
+func TestDeleteRequiresOwner(t *testing.T) {
+	srv, e := newTestServer(t)
+	alice, bob := createKey(t, srv, "alice"), createKey(t, srv, "bob")
+
+	rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"alice-link"}`, "X-API-Key", alice)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("shorten: got %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := do(e, http.MethodDelete, "/alice-link", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous delete: got %d", rec.Code)
+	}
+	if rec := do(e, http.MethodDelete, "/alice-link", "", "X-API-Key", bob); rec.Code != http.StatusForbidden {
+		t.Errorf("other owner delete: got %d", rec.Code)
+	}
+	if rec := do(e, http.MethodDelete, "/alice-link", "", "Authorization", "Bearer "+alice); rec.Code != http.StatusOK {
+		t.Errorf("owner delete: got %d", rec.Code)
+	}
+	if rec := do(e, http.MethodGet, "/alice-link", ""); rec.Code != http.StatusGone {
+		t.Errorf("resolve after delete: got %d", rec.Code)
+	}
+}
+
+func TestUpdateVersionConflict(t *testing.T) {
+	srv, e := newTestServer(t)
+	alice := createKey(t, srv, "alice")
+
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com/tpyo","alias":"typo"}`, "X-API-Key", alice)
+
+	rec := do(e, http.MethodPatch, "/typo", `{"url":"https://example.com/typo","version":1}`, "X-API-Key", alice)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch: got %d: %s", rec.Code, rec.Body)
+	}
+	if v := decode(t, rec)["version"]; v != float64(2) {
+		t.Errorf("version = %v", v)
+	}
+
+	rec = do(e, http.MethodPatch, "/typo", `{"expire":5,"version":1}`, "X-API-Key", alice)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("stale patch: got %d", rec.Code)
+	}
+
+	rec = do(e, http.MethodGet, "/typo", "")
+	if loc := rec.Header().Get("Location"); loc != "https://example.com/typo" {
+		t.Errorf("cache not rewritten, Location = %q", loc)
+	}
+}
+
+func TestShortenBatchCSV(t *testing.T) {
+	_, e := newTestServer(t)
+
+	rec := do(e, http.MethodPost, "/shorten/batch",
+		"url,expire,alias\nhttps://example.com,10,one\nftp://example.com,,two\nhttps://example.org,,one\n",
+		echo.HeaderContentType, "text/csv")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+
+	body := decode(t, rec)
+	if body["created"] != float64(1) || body["failed"] != float64(2) {
+		t.Fatalf("unexpected counts: %v", body)
+	}
+	results := body["results"].([]interface{})
+	if msg := results[2].(map[string]interface{})["error"]; msg != "alias already taken" {
+		t.Errorf("row 2 error = %v", msg)
+	}
+}
+
+func TestShortenBatchJSONRowErrors(t *testing.T) {
+	_, e := newTestServer(t)
+
+	rec := do(e, http.MethodPost, "/shorten/batch", `[{"url":"https://example.com"},{"url":"https://example.org","expire":"soon"}]`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	body := decode(t, rec)
+	if body["created"] != float64(1) || body["failed"] != float64(1) {
+		t.Fatalf("unexpected counts: %v", body)
+	}
+	results := body["results"].([]interface{})
+	if msg := results[1].(map[string]interface{})["error"]; msg != "invalid JSON" {
+		t.Errorf("row 1 error = %v", msg)
+	}
+
+	if rec := do(e, http.MethodPost, "/shorten/batch", `[{"url":"https://example.com"},{"url":`); rec.Code != http.StatusBadRequest {
+		t.Errorf("truncated array: got %d", rec.Code)
+	}
+}
+
+func TestShortenBatchLimits(t *testing.T) {
+	defer func(rows int, body string) {
+		config.AppConfig.BatchMaxSize, config.AppConfig.BatchMaxBody = rows, body
+	}(config.AppConfig.BatchMaxSize, config.AppConfig.BatchMaxBody)
+	config.AppConfig.BatchMaxSize = 2
+	config.AppConfig.BatchMaxBody = "1K"
+	_, e := newTestServer(t)
+
+	// The array is rejected at its third element, before the bad JSON
+	// that follows it is reached.
+	rec := do(e, http.MethodPost, "/shorten/batch", `[{"url":"https://example.com/a"},{"url":"https://example.com/b"},{"url":"https://example.com/c"},{`)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("too many rows: got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(e, http.MethodPost, "/shorten/batch", `{"url":"https://example.com"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("not an array: got %d", rec.Code)
+	}
+	if rec := do(e, http.MethodPost, "/shorten/batch", `[{"url":"https://example.com/`+strings.Repeat("a", 2000)+`"}]`); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body over the limit: got %d", rec.Code)
+	}
+	if rec := do(e, http.MethodPost, "/shorten/batch", `[{"url":"https://example.com/a"},{"url":"https://example.com/b"}]`); rec.Code != http.StatusOK {
+		t.Errorf("batch within the limits: got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestShortenBatchPassword(t *testing.T) {
+	_, e := newTestServer(t)
+
+	rec := do(e, http.MethodPost, "/shorten/batch",
+		`[{"url":"https://example.com/a"},{"url":"https://example.com/b","password":"hunter22"}]`)
+	body := decode(t, rec)
+	if body["created"] != float64(1) || body["failed"] != float64(1) {
+		t.Fatalf("unexpected counts: %v", body)
+	}
+	row := body["results"].([]interface{})[1].(map[string]interface{})
+	if fields, _ := row["fields"].([]interface{}); len(fields) != 1 || fields[0].(map[string]interface{})["field"] != "password" {
+		t.Errorf("protected row: %v", row)
+	}
+}
+
+func TestCreateAPIKeyValidation(t *testing.T) {
+	defer func(d time.Duration) { config.AppConfig.MaxTTL = d }(config.AppConfig.MaxTTL)
+	config.AppConfig.MaxTTL = time.Hour
+	_, e := newTestServer(t)
+	admin := []string{"X-API-Key", testAdminKey}
+
+	for body, field := range map[string]string{
+		`{"default_ttl":10}`:                           "owner",
+		`{"owner":"a","default_ttl":-1}`:               "default_ttl",
+		`{"owner":"a","default_ttl":120,"max_ttl":60}`: "default_ttl",
+		`{"owner":"a","default_ttl":120}`:              "default_ttl",
+	} {
+		rec := do(e, http.MethodPost, "/keys", body, admin...)
+		fields, _ := decode(t, rec)["fields"].([]interface{})
+		if rec.Code != http.StatusBadRequest || len(fields) != 1 || fields[0].(map[string]interface{})["field"] != field {
+			t.Errorf("%s: got %d: %s", body, rec.Code, rec.Body)
+		}
+	}
+	for _, body := range []string{
+		`{"owner":"a","default_ttl":60}`,
+		`{"owner":"a","default_ttl":120,"max_ttl":-1}`,
+		`{"owner":"a","default_ttl":120,"max_ttl":180}`,
+	} {
+		if rec := do(e, http.MethodPost, "/keys", body, admin...); rec.Code != http.StatusCreated {
+			t.Errorf("%s: got %d: %s", body, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	prev := config.AppConfig.RateLimitRedirect
+	config.AppConfig.RateLimitRedirect = 2
+	defer func() { config.AppConfig.RateLimitRedirect = prev }()
+	_, e := newTestServer(t)
+
+	for i := 0; i < 2; i++ {
+		if rec := do(e, http.MethodGet, "/missing", ""); rec.Code != http.StatusNotFound {
+			t.Fatalf("request %d: got %d", i, rec.Code)
+		}
+	}
+	rec := do(e, http.MethodGet, "/missing", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" || rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("missing rate limit headers: %v", rec.Header())
+	}
+}
+
+func TestRateLimitClientIP(t *testing.T) {
+	defer func(limit int, allow, proxies []string) {
+		config.AppConfig.RateLimitRedirect = limit
+		config.AppConfig.RateLimitAllowlist = allow
+		config.AppConfig.TrustedProxies = proxies
+	}(config.AppConfig.RateLimitRedirect, config.AppConfig.RateLimitAllowlist, config.AppConfig.TrustedProxies)
+	config.AppConfig.RateLimitRedirect = 2
+	config.AppConfig.RateLimitAllowlist = []string{"10.0.0.0/8"}
+	config.AppConfig.TrustedProxies = nil
+
+	// Forwarding headers from an untrusted peer get neither a fresh bucket
+	// nor the allowlist.
+	_, e := newTestServer(t)
+	for i, ip := range []string{"198.51.100.1", "198.51.100.2", "10.0.0.1"} {
+		want := http.StatusNotFound
+		if i == 2 {
+			want = http.StatusTooManyRequests
+		}
+		if rec := do(e, http.MethodGet, "/missing", "", echo.HeaderXForwardedFor, ip, echo.HeaderXRealIP, ip); rec.Code != want {
+			t.Errorf("request %d claiming %s: got %d, want %d", i, ip, rec.Code, want)
+		}
+	}
+
+	// Behind a trusted proxy the forwarded client IP counts.
+	config.AppConfig.TrustedProxies = []string{"192.0.2.0/24"}
+	_, e = newTestServer(t)
+	for i := 0; i < 3; i++ {
+		if rec := do(e, http.MethodGet, "/missing", "", echo.HeaderXForwardedFor, "10.0.0.1"); rec.Code != http.StatusNotFound {
+			t.Errorf("allowlisted client behind the proxy: got %d", rec.Code)
+		}
+	}
+	do(e, http.MethodGet, "/missing", "")
+	do(e, http.MethodGet, "/missing", "")
+	if rec := do(e, http.MethodGet, "/missing", "", echo.HeaderXForwardedFor, "198.51.100.1"); rec.Code != http.StatusNotFound {
+		t.Errorf("other client behind the proxy: got %d", rec.Code)
+	}
+}
+
+var errDown = errors.New("connection refused")
+
+type downStore struct{ store.LinkStore }
+
+func (downStore) Ping(context.Context) error { return errDown }
+
+// brokenStore fails every lookup.
+type brokenStore struct{ store.LinkStore }
+
+func (brokenStore) Get(context.Context, string) (store.URL, error) { return store.URL{}, errDown }
+
+// downCache fails every call, like a Redis that is unreachable.
+type downCache struct{}
+
+func (downCache) Get(context.Context, string) ([]byte, error)              { return nil, errDown }
+func (downCache) Set(context.Context, string, []byte, time.Duration) error { return errDown }
+func (downCache) SetMany(context.Context, []store.CacheEntry) error        { return errDown }
+func (downCache) Del(context.Context, ...string) error                     { return errDown }
+func (downCache) Incr(context.Context, string) (int64, error)              { return 0, errDown }
+func (downCache) IncrBounded(context.Context, string, int64, *int64, time.Duration) (int64, error) {
+	return 0, errDown
+}
+func (downCache) Ping(context.Context) error { return errDown }
+func (downCache) SlidingWindow(context.Context, string, int, time.Duration) (store.WindowResult, error) {
+	return store.WindowResult{}, errDown
+}
+func (downCache) Uncount(context.Context, string, string) error { return errDown }
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name   string
+		links  store.LinkStore
+		cache  store.Cache
+		code   int
+		status string
+	}{
+		{"healthy", store.NewMemoryStore(), store.NewMemoryCache(), http.StatusOK, "ok"},
+		{"redis down", store.NewMemoryStore(), downCache{}, http.StatusOK, "degraded"},
+		{"mongo down", downStore{store.NewMemoryStore()}, store.NewMemoryCache(), http.StatusServiceUnavailable, "unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewServer(tt.links, tt.cache).SetupRouter()
+			rec := do(e, http.MethodGet, "/readyz", "")
+			if rec.Code != tt.code {
+				t.Fatalf("got %d: %s", rec.Code, rec.Body)
+			}
+			if status := decode(t, rec)["status"]; status != tt.status {
+				t.Errorf("status = %v", status)
+			}
+			if rec := do(e, http.MethodGet, "/livez", ""); rec.Code != http.StatusOK {
+				t.Errorf("livez: got %d", rec.Code)
+			}
+		})
+	}
+}
+
+func TestReadyzDraining(t *testing.T) {
+	srv, e := newTestServer(t)
+	srv.Drain()
+	if rec := do(e, http.MethodGet, "/readyz", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d", rec.Code)
+	}
+}
+
+func TestResolveWithoutRedis(t *testing.T) {
+	links := store.NewMemoryStore()
+	e := NewServer(links, downCache{}).SetupRouter()
+
+	rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"still-up"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("shorten: got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(e, http.MethodGet, "/still-up", ""); rec.Code != http.StatusFound {
+		t.Fatalf("resolve: got %d", rec.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	_, e := newTestServer(t)
+
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"measured"}`)
+	do(e, http.MethodGet, "/measured", "")
+	do(e, http.MethodGet, "/unknown-link", "")
+	broken := NewServer(brokenStore{store.NewMemoryStore()}, store.NewMemoryCache()).SetupRouter()
+	if rec := do(broken, http.MethodGet, "/any-link", ""); rec.Code != http.StatusInternalServerError {
+		t.Errorf("failed lookup: got %d", rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`urlshortener_redirects_total{outcome="hit"}`,
+		`urlshortener_redirects_total{outcome="not_found"}`,
+		`urlshortener_redirects_total{outcome="error"}`,
+		`urlshortener_cache_lookups_total{result="hit"}`,
+		`urlshortener_http_requests_total{code="302",method="GET",route="/:hsh"}`,
+		`urlshortener_http_request_duration_seconds_bucket{method="POST",route="/shorten",le="0.001"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if strings.Contains(body, "measured") {
+		t.Error("short IDs leaked into metric labels")
+	}
+}
+
+// redirects reads urlshortener_redirects_total for outcome, which is shared
+// by every test, so callers compare it before and after.
+func redirects(t *testing.T, outcome string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	prefix := `urlshortener_redirects_total{outcome="` + outcome + `"} `
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if v, ok := strings.CutPrefix(line, prefix); ok {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatalf("parsing %q: %v", line, err)
+			}
+			return n
+		}
+	}
+	return 0
+}
+
+func TestUnlockMetrics(t *testing.T) {
+	_, e := newTestServer(t)
+	form := []string{echo.HeaderContentType, echo.MIMEApplicationForm}
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"counted","password":"hunter22"}`)
+
+	notFound := redirects(t, "not_found")
+	do(e, http.MethodPost, "/no-such-link", "password=hunter22", form...)
+	if got := redirects(t, "not_found"); got != notFound+1 {
+		t.Errorf("unknown link: not_found went from %v to %v", notFound, got)
+	}
+
+	resolved := redirects(t, "hit") + redirects(t, "miss")
+	do(e, http.MethodPost, "/counted", "password=wrong", form...)
+	if got := redirects(t, "hit") + redirects(t, "miss"); got != resolved {
+		t.Errorf("wrong password counted as a redirect")
+	}
+	if rec := do(e, http.MethodPost, "/counted", "password=hunter22", form...); rec.Code != http.StatusSeeOther {
+		t.Fatalf("unlock: got %d", rec.Code)
+	}
+	if got := redirects(t, "hit") + redirects(t, "miss"); got != resolved+1 {
+		t.Errorf("unlock: hits and misses went from %v to %v", resolved, got)
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	_, e := newTestServer(t)
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	do(e, http.MethodGet, "/traced", "", "traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	do(e, http.MethodGet, "/readyz", "")
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected one span, got %d", len(spans))
+	}
+	if got := spans[0].SpanContext().TraceID().String(); got != traceID {
+		t.Errorf("trace ID = %s", got)
+	}
+	if name := spans[0].Name(); name != "GET /:hsh" {
+		t.Errorf("span name = %q", name)
+	}
+}
+
+// countingStore counts Get calls and, when gate is set, blocks them until
+// it is closed.
+type countingStore struct {
+	store.LinkStore
+	gets atomic.Int32
+	gate chan struct{}
+}
+
+func (s *countingStore) Get(ctx context.Context, id string) (store.URL, error) {
+	s.gets.Add(1)
+	if s.gate != nil {
+		<-s.gate
+	}
+	return s.LinkStore.Get(ctx, id)
+}
+
+func TestNegativeCache(t *testing.T) {
+	links := &countingStore{LinkStore: store.NewMemoryStore()}
+	e := NewServer(links, store.NewMemoryCache()).SetupRouter()
+
+	for i := 0; i < 3; i++ {
+		if rec := do(e, http.MethodGet, "/nothing-here", ""); rec.Code != http.StatusNotFound {
+			t.Fatalf("got %d", rec.Code)
+		}
+	}
+	if n := links.gets.Load(); n != 1 {
+		t.Errorf("store queried %d times", n)
+	}
+
+	// A link created under a negatively cached ID is served right away.
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"nothing-here"}`)
+	if rec := do(e, http.MethodGet, "/nothing-here", ""); rec.Code != http.StatusFound {
+		t.Errorf("new link: got %d", rec.Code)
+	}
+}
+
+func TestInvalidIDSkipsStore(t *testing.T) {
+	links := &countingStore{LinkStore: store.NewMemoryStore()}
+	e := NewServer(links, store.NewMemoryCache()).SetupRouter()
+
+	if rec := do(e, http.MethodGet, "/not.an.id", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("got %d", rec.Code)
+	}
+	if n := links.gets.Load(); n != 0 {
+		t.Errorf("store queried %d times", n)
+	}
+}
+
+func TestFilterRejectsUnknownIDs(t *testing.T) {
+	links := &countingStore{LinkStore: store.NewMemoryStore()}
+	srv := NewServer(links, store.NewMemoryCache())
+	srv.Filter = store.NewMemoryFilter()
+	e := srv.SetupRouter()
+
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"filtered"}`)
+	srv.Cache.Del(context.Background(), cacheKey("filtered"))
+
+	if rec := do(e, http.MethodGet, "/unknown", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown: got %d", rec.Code)
+	}
+	if n := links.gets.Load(); n != 0 {
+		t.Errorf("store queried %d times for an unknown ID", n)
+	}
+	if rec := do(e, http.MethodGet, "/filtered", ""); rec.Code != http.StatusFound {
+		t.Fatalf("known: got %d", rec.Code)
+	}
+
+	// Without a built filter every lookup falls through to the store.
+	srv.Filter.Invalidate(context.Background())
+	do(e, http.MethodGet, "/unknown", "")
+	if n := links.gets.Load(); n != 2 {
+		t.Errorf("store queried %d times", n)
+	}
+}
+
+func TestLookupsAreCoalesced(t *testing.T) {
+	links := &countingStore{LinkStore: store.NewMemoryStore()}
+	srv := NewServer(links, store.NewMemoryCache())
+	e := srv.SetupRouter()
+
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"viral"}`)
+	srv.Cache.Del(context.Background(), cacheKey("viral"))
+	links.gate = make(chan struct{})
+
+	const clients = 20
+	codes := make(chan int, clients)
+	for i := 0; i < clients; i++ {
+		go func() { codes <- do(e, http.MethodGet, "/viral", "").Code }()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(links.gate)
+
+	for i := 0; i < clients; i++ {
+		if code := <-codes; code != http.StatusFound {
+			t.Errorf("got %d", code)
+		}
+	}
+	if n := links.gets.Load(); n != 1 {
+		t.Errorf("store queried %d times", n)
+	}
+}
+
+// fixedIDs hands out ids in order, then repeats the last one.
+type fixedIDs struct {
+	ids []string
+	n   atomic.Int32
+}
+
+func (g *fixedIDs) Next(context.Context) (string, error) {
+	i := min(int(g.n.Add(1))-1, len(g.ids)-1)
+	return g.ids[i], nil
+}
+
+func TestShortenRetriesCollisions(t *testing.T) {
+	srv, e := newTestServer(t)
+	taken := store.URL{ID: "taken", Original: "https://example.org", Version: 1}
+	if err := srv.Links.Insert(context.Background(), taken); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.IDs = &fixedIDs{ids: []string{"taken", "shorten", "fresh"}}
+	rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.com"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("shorten: got %d: %s", rec.Code, rec.Body)
+	}
+	if got := decode(t, rec)["short_url"]; got != "http://sho.rt/fresh" {
+		t.Errorf("got %v, want the first free, unreserved ID", got)
+	}
+
+	srv.IDs = &fixedIDs{ids: []string{"taken"}}
+	rec = do(e, http.MethodPost, "/shorten", `{"url":"https://example.com"}`)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("exhausted retries: got %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = do(e, http.MethodPost, "/shorten/batch", `[{"url":"https://example.com"},{"url":"https://example.net"}]`)
+	results := decode(t, rec)["results"].([]interface{})
+	for i, r := range results {
+		if msg := r.(map[string]interface{})["error"]; msg != "could not generate a unique ID" {
+			t.Errorf("batch row %d: got %v", i, msg)
+		}
+	}
+}
+
+func TestLinkQR(t *testing.T) {
+	_, e := newTestServer(t)
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"printed"}`)
+
+	rec := do(e, http.MethodGet, "/printed/qr?size=200&margin=2&fg=%23003366&bg=fff0", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("png: got %d: %s", rec.Code, rec.Body)
+	}
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 200 || b.Dy() != 200 {
+		t.Errorf("png is %v, want 200x200", b)
+	}
+	etag := rec.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"printed.1.`) {
+		t.Errorf("ETag %q does not carry the ID and version", etag)
+	}
+
+	rec = do(e, http.MethodGet, "/printed/qr?size=200&margin=2&fg=%23003366&bg=fff0", "", "If-None-Match", etag)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("revalidation: got %d", rec.Code)
+	}
+	rec = do(e, http.MethodGet, "/printed/qr?size=300", "", "If-None-Match", etag)
+	if rec.Code != http.StatusOK {
+		t.Errorf("other options reused the ETag: got %d", rec.Code)
+	}
+
+	rec = do(e, http.MethodGet, "/printed/qr?format=svg&ec=H", "")
+	if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentType) != "image/svg+xml" ||
+		!strings.HasPrefix(rec.Body.String(), "<svg") {
+		t.Errorf("svg: got %d %s", rec.Code, rec.Header().Get(echo.HeaderContentType))
+	}
+
+	if rec := do(e, http.MethodGet, "/printed/qr?size=9&ec=X&fg=blue", ""); rec.Code != http.StatusBadRequest ||
+		len(decode(t, rec)["fields"].([]interface{})) != 3 {
+		t.Errorf("invalid options: got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(e, http.MethodGet, "/missing/qr", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown link: got %d", rec.Code)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	srv, e := newTestServer(t)
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com/a?b=<c>","alias":"peek"}`)
+
+	for _, path := range []string{"/peek+", "/peek?preview=1"} {
+		rec := do(e, http.MethodGet, path, "")
+		if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), echo.MIMETextHTML) {
+			t.Fatalf("%s: got %d %s", path, rec.Code, rec.Header().Get(echo.HeaderContentType))
+		}
+		body := rec.Body.String()
+		if !strings.Contains(body, "https://example.com/a?b=%3cc%3e") || !strings.Contains(body, "Never") {
+			t.Errorf("%s: target or expiry missing from %s", path, body)
+		}
+		if strings.Contains(body, "<c>") {
+			t.Errorf("%s: target was not escaped", path)
+		}
+		if csp := rec.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "form-action 'self'") {
+			t.Errorf("%s: policy %q does not restrict forms", path, csp)
+		}
+	}
+	if n := len(srv.clicks); n != 0 {
+		t.Errorf("previews recorded %d clicks", n)
+	}
+
+	if rec := do(e, http.MethodGet, "/peek", ""); rec.Code != http.StatusFound {
+		t.Errorf("plain redirect: got %d", rec.Code)
+	}
+	if rec := do(e, http.MethodGet, "/nothing+", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown preview: got %d", rec.Code)
+	}
+}
+
+func TestForcedInterstitial(t *testing.T) {
+	srv, e := newTestServer(t)
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"careful","interstitial":true}`)
+
+	rec := do(e, http.MethodGet, "/careful", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Continue to example.com") {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	if len(srv.clicks) != 1 {
+		t.Error("the interstitial did not count as a click")
+	}
+
+	key := createKey(t, srv, "alice")
+	srv.Links.Insert(context.Background(), store.URL{ID: "owned", Original: "https://example.org", Owner: "alice", Version: 1})
+	rec = do(e, http.MethodPatch, "/owned", `{"version":1,"interstitial":true}`, "X-API-Key", key)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch: got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(e, http.MethodGet, "/owned", ""); rec.Code != http.StatusOK {
+		t.Errorf("after enabling the interstitial: got %d", rec.Code)
+	}
+}
+
+func TestPasswordProtectedLink(t *testing.T) {
+	srv, e := newTestServer(t)
+	form := []string{echo.HeaderContentType, echo.MIMEApplicationForm}
+
+	rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.com/internal","alias":"locked","password":"hunter22"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("shorten: got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","password":"abc"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("short password: got %d", rec.Code)
+	}
+
+	for _, path := range []string{"/locked", "/locked+"} {
+		rec := do(e, http.MethodGet, path, "")
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `name="password"`) {
+			t.Fatalf("%s: got %d: %s", path, rec.Code, rec.Body)
+		}
+		if strings.Contains(rec.Body.String(), "internal") {
+			t.Errorf("%s: form leaks the target", path)
+		}
+		if rec.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("%s: form is cacheable", path)
+		}
+		// The form is answered with a redirect off-site, which form-action
+		// would block.
+		if csp := rec.Header().Get("Content-Security-Policy"); csp == "" || strings.Contains(csp, "form-action") {
+			t.Errorf("%s: policy %q", path, csp)
+		}
+	}
+
+	rec = do(e, http.MethodPost, "/locked", "password=wrong", form...)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("wrong password: got %d", rec.Code)
+	}
+	rec = do(e, http.MethodPost, "/locked", "password=hunter22", form...)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "https://example.com/internal" {
+		t.Errorf("right password: got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if len(srv.clicks) != 1 {
+		t.Error("unlocking did not count as a click")
+	}
+
+	stored, _ := srv.Links.Get(context.Background(), "locked")
+	if data, _ := json.Marshal(stored); strings.Contains(string(data), stored.PasswordHash) {
+		t.Error("password hash is serialized to JSON")
+	}
+}
+
+func TestPasswordThrottling(t *testing.T) {
+	defer func(n int) { config.AppConfig.PasswordFailuresIP = n }(config.AppConfig.PasswordFailuresIP)
+	config.AppConfig.PasswordFailuresIP = 2
+
+	_, e := newTestServer(t)
+	form := []string{echo.HeaderContentType, echo.MIMEApplicationForm}
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"guarded","password":"hunter22"}`)
+
+	// Right passwords do not count towards the limit.
+	for i := 0; i < 3; i++ {
+		if rec := do(e, http.MethodPost, "/guarded", "password=hunter22", form...); rec.Code != http.StatusSeeOther {
+			t.Fatalf("right password %d: got %d", i, rec.Code)
+		}
+	}
+	do(e, http.MethodPost, "/guarded", "password=guess1", form...)
+	do(e, http.MethodPost, "/guarded", "password=guess2", form...)
+	rec := do(e, http.MethodPost, "/guarded", "password=hunter22", form...)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get(echo.HeaderRetryAfter) == "" {
+		t.Errorf("after the limit: got %d", rec.Code)
+	}
+
+	spoofed := append([]string{echo.HeaderXForwardedFor, "198.51.100.7", echo.HeaderXRealIP, "198.51.100.7"}, form...)
+	if rec := do(e, http.MethodPost, "/guarded", "password=hunter22", spoofed...); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("spoofed client IP: got %d", rec.Code)
+	}
+	if rec := doFrom(e, "198.51.100.7:1234", http.MethodPost, "/guarded", "password=hunter22", form...); rec.Code != http.StatusSeeOther {
+		t.Errorf("another client: got %d", rec.Code)
+	}
+
+	// Rotating forwarding headers does not spread guesses over many IPs.
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"rotated","password":"hunter22"}`)
+	for i, ip := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"} {
+		rec := doFrom(e, "198.51.100.8:1234", http.MethodPost, "/rotated", "password=guess", append([]string{echo.HeaderXForwardedFor, ip}, form...)...)
+		if i == 2 && rec.Code != http.StatusTooManyRequests {
+			t.Errorf("guess %d claiming %s: got %d", i, ip, rec.Code)
+		}
+	}
+}
+
+func TestPasswordThrottlingConcurrent(t *testing.T) {
+	defer func(n int) { config.AppConfig.PasswordFailuresIP = n }(config.AppConfig.PasswordFailuresIP)
+	config.AppConfig.PasswordFailuresIP = 5
+
+	_, e := newTestServer(t)
+	form := []string{echo.HeaderContentType, echo.MIMEApplicationForm}
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"raced","password":"hunter22"}`)
+
+	// Guesses arriving together must not all be compared before the first
+	// failure is counted.
+	var wrong, throttled atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch do(e, http.MethodPost, "/raced", "password=guess", form...).Code {
+			case http.StatusForbidden:
+				wrong.Add(1)
+			case http.StatusTooManyRequests:
+				throttled.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if wrong.Load() != 5 || throttled.Load() != 45 {
+		t.Errorf("%d compared, %d throttled; want 5 and 45", wrong.Load(), throttled.Load())
+	}
+}
+
+func TestClickLimitedLink(t *testing.T) {
+	srv, e := newTestServer(t)
+	if rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","max_clicks":-1}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("negative max_clicks: got %d", rec.Code)
+	}
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com/once","alias":"once","max_clicks":3}`)
+
+	// HEAD neither uses a click nor reveals the target; a preview uses one.
+	for i := 0; i < 4; i++ {
+		rec := do(e, http.MethodHead, "/once", "")
+		if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderLocation) != "" {
+			t.Fatalf("HEAD: got %d to %q", rec.Code, rec.Header().Get(echo.HeaderLocation))
+		}
+	}
+	if rec := do(e, http.MethodGet, "/once+", ""); rec.Code != http.StatusOK {
+		t.Fatalf("preview: got %d", rec.Code)
+	}
+	rec := do(e, http.MethodGet, "/once", "")
+	if rec.Code != http.StatusFound || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("first click: got %d, Cache-Control %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+
+	// Losing the Redis counter must not hand out the clicks again.
+	ctx := context.Background()
+	srv.Cache.Del(ctx, usageKey("once"))
+	if url, _ := srv.Links.Get(ctx, "once"); url.Used != 2 {
+		t.Fatalf("used = %d in the store, want 2", url.Used)
+	}
+	if rec := do(e, http.MethodGet, "/once", ""); rec.Code != http.StatusFound {
+		t.Fatalf("second click: got %d", rec.Code)
+	}
+	if rec := do(e, http.MethodGet, "/once", ""); rec.Code != http.StatusGone {
+		t.Fatalf("third click: got %d: %s", rec.Code, rec.Body)
+	}
+	if len(srv.clicks) != 3 {
+		t.Errorf("recorded %d clicks, want 3", len(srv.clicks))
+	}
+
+	// Once used up, nothing may reveal the target any more.
+	for _, req := range []struct{ method, path string }{
+		{http.MethodHead, "/once"},
+		{http.MethodGet, "/once+"},
+		{http.MethodGet, "/once?preview=1"},
+	} {
+		rec := do(e, req.method, req.path, "")
+		if rec.Code != http.StatusGone || rec.Header().Get(echo.HeaderLocation) != "" || strings.Contains(rec.Body.String(), "example.com") {
+			t.Errorf("%s %s when exhausted: got %d: %s", req.method, req.path, rec.Code, rec.Body)
+		}
+	}
+	srv.Cache.Del(ctx, usageKey("once"))
+	if rec := do(e, http.MethodHead, "/once", ""); rec.Code != http.StatusGone {
+		t.Errorf("HEAD without a counter: got %d", rec.Code)
+	}
+}
+
+func TestClickLimitWithoutRedis(t *testing.T) {
+	srv, e := newTestServer(t)
+	srv.Cache = downCache{}
+	ctx := context.Background()
+	srv.Links.Insert(ctx, store.URL{ID: "once", Original: "https://example.com", Version: 1, MaxClicks: 1})
+
+	if rec := do(e, http.MethodGet, "/once", ""); rec.Code != http.StatusFound {
+		t.Fatalf("first click: got %d", rec.Code)
+	}
+	if rec := do(e, http.MethodGet, "/once", ""); rec.Code != http.StatusGone {
+		t.Fatalf("second click: got %d", rec.Code)
+	}
+
+	// The fallback must not count clicks on deleted links.
+	srv.Links.Insert(ctx, store.URL{ID: "twice", Original: "https://example.com", Version: 1, MaxClicks: 2})
+	srv.Links.Delete(ctx, "twice", "")
+	if _, err := srv.Links.ConsumeClick(ctx, "twice"); err != store.ErrLimitReached {
+		t.Errorf("click on a deleted link: %v", err)
+	}
+}
+
+func TestScheduledActivation(t *testing.T) {
+	srv, e := newTestServer(t)
+	ctx := context.Background()
+	launch := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	if rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","activate_at":"tomorrow"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad timestamp: got %d", rec.Code)
+	}
+	if rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","expire":30,"activate_at":"`+launch+`"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("activation after expiry: got %d", rec.Code)
+	}
+
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com/sale","alias":"launch","activate_at":"`+launch+`"}`)
+	for _, path := range []string{"/launch", "/launch+"} {
+		rec := do(e, http.MethodGet, path, "")
+		if rec.Code != http.StatusNotFound || strings.Contains(rec.Body.String(), "example.com") {
+			t.Fatalf("%s before activation: got %d: %s", path, rec.Code, rec.Body)
+		}
+		if rec.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("%s: Cache-Control %q", path, rec.Header().Get("Cache-Control"))
+		}
+	}
+	if _, err := srv.Cache.Get(ctx, cacheKey("launch")); err != store.ErrCacheMiss {
+		t.Errorf("pending link was cached: %v", err)
+	}
+	if len(srv.clicks) != 0 {
+		t.Error("a click was recorded before activation")
+	}
+
+	// In notfound mode the link cannot be told apart from a missing one.
+	config.AppConfig.NotActiveResponse = notActiveNotFound
+	for _, accept := range []string{echo.MIMEApplicationJSON, echo.MIMETextHTML} {
+		rec := do(e, http.MethodGet, "/launch", "", echo.HeaderAccept, accept)
+		missing := do(e, http.MethodGet, "/never-created", "", echo.HeaderAccept, accept)
+		if rec.Code != http.StatusNotFound || rec.Body.String() != missing.Body.String() {
+			t.Errorf("notfound mode for %s: got %d: %s", accept, rec.Code, rec.Body)
+		}
+	}
+	config.AppConfig.NotActiveResponse = notActivePage
+
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com/sale","alias":"teaser","activate_at":"`+launch+`","fallback_url":"https://example.com/soon"}`)
+	rec := do(e, http.MethodGet, "/teaser", "")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "https://example.com/soon" {
+		t.Fatalf("fallback: got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	key := createKey(t, srv, "alice")
+	srv.Links.Insert(ctx, store.URL{ID: "owned", Original: "https://example.org", Owner: "alice", Version: 1})
+	do(e, http.MethodGet, "/owned", "")
+	rec = do(e, http.MethodPatch, "/owned", `{"version":1,"activate_at":"`+launch+`"}`, "X-API-Key", key)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch: got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(e, http.MethodGet, "/owned", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("after postponing: got %d", rec.Code)
+	}
+	do(e, http.MethodPatch, "/owned", `{"version":2,"activate_at":""}`, "X-API-Key", key)
+	if rec := do(e, http.MethodGet, "/owned", ""); rec.Code != http.StatusFound {
+		t.Errorf("after activating: got %d", rec.Code)
+	}
+
+	// Patches are checked against the fields they leave alone.
+	do(e, http.MethodPatch, "/owned", `{"version":3,"expire":30}`, "X-API-Key", key)
+	if rec := do(e, http.MethodPatch, "/owned", `{"version":4,"activate_at":"`+launch+`"}`, "X-API-Key", key); rec.Code != http.StatusBadRequest {
+		t.Errorf("activation after the current expiry: got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(e, http.MethodPatch, "/owned", `{"version":4,"activate_at":"`+launch+`","expire":120}`, "X-API-Key", key); rec.Code != http.StatusOK {
+		t.Fatalf("activation with a later expiry: got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(e, http.MethodPatch, "/owned", `{"version":5,"expire":30}`, "X-API-Key", key); rec.Code != http.StatusBadRequest {
+		t.Errorf("expiry before the activation: got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestListLinks(t *testing.T) {
+	srv, e := newTestServer(t)
+	alice, bob := createKey(t, srv, "alice"), createKey(t, srv, "bob")
+
+	for i, body := range []string{
+		`{"url":"https://example.com/a","alias":"link-a","tags":["Launch","q3","launch"]}`,
+		`{"url":"https://example.com/b","alias":"link-b","tags":["q3"]}`,
+		`{"url":"https://other.org/c","alias":"link-c","expire":60}`,
+	} {
+		if rec := do(e, http.MethodPost, "/shorten", body, "X-API-Key", alice); rec.Code != http.StatusOK {
+			t.Fatalf("shorten %d: got %d: %s", i, rec.Code, rec.Body)
+		}
+	}
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com/d","alias":"link-d"}`, "X-API-Key", bob)
+	if rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","tags":["no spaces"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid tag: got %d", rec.Code)
+	}
+	if rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"links"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("reserved alias: got %d", rec.Code)
+	}
+
+	ids := func(rec *httptest.ResponseRecorder) (out []string, cursor string) {
+		t.Helper()
+		var body struct {
+			Links      []store.URL `json:"links"`
+			NextCursor string      `json:"next_cursor"`
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", rec.Code, rec.Body)
+		}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		for _, url := range body.Links {
+			out = append(out, url.ID)
+		}
+		return out, body.NextCursor
+	}
+
+	page, cursor := ids(do(e, http.MethodGet, "/links?limit=2", "", "X-API-Key", alice))
+	if len(page) != 2 || cursor == "" {
+		t.Fatalf("first page: %v, cursor %q", page, cursor)
+	}
+	rest, next := ids(do(e, http.MethodGet, "/links?limit=2&cursor="+cursor, "", "X-API-Key", alice))
+	if got := append(page, rest...); strings.Join(got, ",") != "link-c,link-b,link-a" || next != "" {
+		t.Errorf("pages: %v, next cursor %q", got, next)
+	}
+	if rec := do(e, http.MethodGet, "/links?sort=clicks&cursor="+cursor, "", "X-API-Key", alice); rec.Code != http.StatusBadRequest {
+		t.Errorf("cursor of another sort: got %d", rec.Code)
+	}
+
+	for query, want := range map[string]string{
+		"tag=LAUNCH":             "link-a",
+		"tag=q3&sort=created_at": "link-a,link-b",
+		"domain=other.org":       "link-c",
+		"expiry=permanent":       "link-b,link-a",
+		"expiry=expiring":        "link-c",
+	} {
+		if got, _ := ids(do(e, http.MethodGet, "/links?"+query, "", "X-API-Key", alice)); strings.Join(got, ",") != want {
+			t.Errorf("%s: got %v, want %s", query, got, want)
+		}
+	}
+
+	now := time.Now()
+	srv.Links.RecordClicks(context.Background(), []store.Click{{ShortID: "link-b", Timestamp: now}, {ShortID: "link-b", Timestamp: now}, {ShortID: "link-a", Timestamp: now}})
+	if got, _ := ids(do(e, http.MethodGet, "/links?sort=-clicks", "", "X-API-Key", alice)); strings.Join(got, ",") != "link-b,link-a,link-c" {
+		t.Errorf("by clicks: %v", got)
+	}
+
+	if rec := do(e, http.MethodGet, "/links?owner=alice", "", "X-API-Key", bob); rec.Code != http.StatusForbidden {
+		t.Errorf("listing another owner: got %d", rec.Code)
+	}
+	if rec := do(e, http.MethodGet, "/links", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous: got %d", rec.Code)
+	}
+	if got, _ := ids(do(e, http.MethodGet, "/links?owner=bob", "", "X-API-Key", testAdminKey)); strings.Join(got, ",") != "link-d" {
+		t.Errorf("admin filtering by owner: %v", got)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	srv, e := newTestServer(t)
+	defer func(d time.Duration) { config.AppConfig.NegativeCacheTTL = d }(config.AppConfig.NegativeCacheTTL)
+	config.AppConfig.NegativeCacheTTL = time.Minute
+	alice := createKey(t, srv, "alice")
+	past := time.Now().Add(-time.Hour)
+	srv.Links.Insert(context.Background(), store.URL{ID: "old-promo", Original: "https://example.com", Version: 1, ExpireAt: &past})
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"retired"}`, "X-API-Key", alice)
+	do(e, http.MethodDelete, "/retired", "", "X-API-Key", alice)
+
+	for id, reason := range map[string]string{"old-promo": "expired", "retired": "deleted"} {
+		// The second request is answered from the negative cache.
+		for i := 0; i < 2; i++ {
+			rec := do(e, http.MethodGet, "/"+id, "")
+			if rec.Code != http.StatusGone || decode(t, rec)["reason"] != reason {
+				t.Fatalf("%s: got %d: %s", id, rec.Code, rec.Body)
+			}
+		}
+	}
+	if rec := do(e, http.MethodDelete, "/retired", "", "X-API-Key", alice); rec.Code != http.StatusNotFound {
+		t.Errorf("deleting twice: got %d", rec.Code)
+	}
+	if rec := do(e, http.MethodGet, "/links", "", "X-API-Key", alice); strings.Contains(rec.Body.String(), "retired") {
+		t.Errorf("deleted link listed: %s", rec.Body)
+	}
+
+	// Tombstones do not hold on to their IDs.
+	rec := do(e, http.MethodPost, "/shorten", `{"url":"https://example.org","alias":"retired"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reusing a deleted alias: got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(e, http.MethodGet, "/retired", ""); rec.Code != http.StatusFound {
+		t.Errorf("reused alias: got %d", rec.Code)
+	}
+
+	// Links that are not live yet are never cached, so creating one must
+	// clear what was remembered about its ID.
+	launch := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	do(e, http.MethodGet, "/coming-soon", "")
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"old-promo","activate_at":"`+launch+`","fallback_url":"https://example.com/soon"}`)
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"coming-soon","activate_at":"`+launch+`","fallback_url":"https://example.com/soon"}`)
+	for _, id := range []string{"old-promo", "coming-soon"} {
+		if rec := do(e, http.MethodGet, "/"+id, ""); rec.Code != http.StatusFound {
+			t.Errorf("%s created after a miss: got %d: %s", id, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestStatsOfReusedID(t *testing.T) {
+	srv, e := newTestServer(t)
+	ctx := context.Background()
+	alice := createKey(t, srv, "alice")
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.com","alias":"promo"}`, "X-API-Key", alice)
+	srv.Links.RecordClicks(ctx, []store.Click{{ShortID: "promo", Timestamp: time.Now(), Visitor: "v1"}})
+	do(e, http.MethodDelete, "/promo", "", "X-API-Key", alice)
+
+	time.Sleep(time.Millisecond)
+	do(e, http.MethodPost, "/shorten", `{"url":"https://example.org","alias":"promo"}`, "X-API-Key", alice)
+	// A click queued for the deleted link lands after the ID was reused.
+	old := time.Now().Add(-time.Hour)
+	srv.Links.RecordClicks(ctx, []store.Click{{ShortID: "promo", Timestamp: old, Visitor: "v1"}})
+
+	stats := decode(t, do(e, http.MethodGet, "/promo/stats", ""))
+	if stats["total_clicks"] != float64(0) || stats["unique_visitors"] != float64(0) {
+		t.Errorf("reused ID inherited clicks: %v", stats)
+	}
+	if url, _ := srv.Links.Get(ctx, "promo"); url.Clicks != 0 {
+		t.Errorf("clicks = %d, want 0", url.Clicks)
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	srv, e := newTestServer(t)
+	past := time.Now().Add(-time.Hour)
+	srv.Links.Insert(context.Background(), store.URL{ID: "old-promo", Original: "https://example.com", Version: 1, ExpireAt: &past})
+	browser := []string{echo.HeaderAccept, "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"}
+
+	rec := do(e, http.MethodGet, "/old-promo", "", browser...)
+	if rec.Code != http.StatusGone || !strings.Contains(rec.Body.String(), "This link has expired") {
+		t.Fatalf("browser: got %d: %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Header().Get(echo.HeaderVary), echo.HeaderAccept) {
+		t.Errorf("Vary = %q", rec.Header().Get(echo.HeaderVary))
+	}
+	if rec := do(e, http.MethodGet, "/nothing-here", "", browser...); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "Link not found") {
+		t.Errorf("browser, unknown link: got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(e, http.MethodGet, "/a/b/c", "", browser...); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "<html") {
+		t.Errorf("browser, unknown route: got %d: %s", rec.Code, rec.Body)
+	}
+
+	for _, accept := range []string{"", "*/*", "application/json", "text/html;q=0.5, application/json"} {
+		rec := do(e, http.MethodGet, "/old-promo", "", echo.HeaderAccept, accept)
+		if rec.Code != http.StatusGone || decode(t, rec)["error"] != "URL expired" {
+			t.Errorf("Accept %q: got %d: %s", accept, rec.Code, rec.Body)
+		}
+	}
+	if rec := do(e, http.MethodGet, "/a/b/c", ""); decode(t, rec)["error"] == nil {
+		t.Errorf("unknown route: %s", rec.Body)
+	}
+}
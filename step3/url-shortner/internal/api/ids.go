@@ -0,0 +1,92 @@
+package api
+
+import (
+	"log"
+	"strings"
+	"url-shortner/internal/config"
+	"url-shortner/internal/metrics"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+// nextID returns a generated ID that does not shadow a route.
+func (s *Server) nextID(c echo.Context) (string, error) {
+	ctx, cancel := opContext(c)
+	defer cancel()
+	for {
+		id, err := s.IDs.Next(ctx)
+		if err != nil {
+			log.Printf("generating ID failed: %v", err)
+			return "", errGenerateID
+		}
+		if _, reserved := reservedAliases[strings.ToLower(id)]; !reserved {
+			return id, nil
+		}
+	}
+}
+
+// insertLinks stores urls, first generating the IDs of those that are not
+// aliases. A generated ID that turns out to be taken is replaced and the
+// link retried, up to IDRETRIES times. It returns one error per url, like
+// LinkStore.InsertMany, and leaves the stored IDs in urls. IDs that were
+// remembered as missing, such as a reclaimed tombstone or an alias looked up
+// before it was created, are forgotten.
+func (s *Server) insertLinks(c echo.Context, urls []store.URL) []error {
+	errs := make([]error, len(urls))
+	pending := make([]int, len(urls))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for attempt := 0; len(pending) > 0; attempt++ {
+		batch := make([]store.URL, 0, len(pending))
+		rows := make([]int, 0, len(pending))
+		for _, i := range pending {
+			if !urls[i].Alias {
+				id, err := s.nextID(c)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				urls[i].ID = id
+			}
+			batch = append(batch, urls[i])
+			rows = append(rows, i)
+		}
+
+		ids := make([]string, len(batch))
+		for j, url := range batch {
+			ids[j] = url.ID
+		}
+		s.addToFilter(c, ids...)
+
+		ctx, cancel := opContext(c)
+		batchErrs := s.Links.InsertMany(ctx, batch)
+		cancel()
+
+		pending = nil
+		for j, i := range rows {
+			errs[i] = batchErrs[j]
+			if errs[i] == store.ErrDuplicate && !urls[i].Alias {
+				metrics.IDCollision()
+				if attempt < config.AppConfig.IDRetries {
+					pending = append(pending, i)
+				}
+			}
+		}
+	}
+
+	var stored []string
+	for i, url := range urls {
+		if errs[i] == nil {
+			stored = append(stored, negativeKey(url.ID))
+		}
+	}
+	if config.AppConfig.NegativeCacheTTL > 0 && len(stored) > 0 {
+		ctx, cancel := detachedContext(c)
+		s.Cache.Del(ctx, stored...)
+		cancel()
+	}
+	return errs
+}
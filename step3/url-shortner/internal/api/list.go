@@ -0,0 +1,136 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	listDefaultLimit = 20
+	listMaxLimit     = 100
+)
+
+// listCursor is what next_cursor encodes: the last link of a page and the
+// sort it was listed in, so a cursor is not replayed against another order.
+type listCursor struct {
+	Sort string `json:"s"`
+	store.LinkCursor
+}
+
+func encodeCursor(sort string, url store.URL) string {
+	b, _ := json.Marshal(listCursor{Sort: sort, LinkCursor: url.Cursor()})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s, sort string) (*store.LinkCursor, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+	var c listCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Sort != sort || c.ID == "" {
+		return nil, false
+	}
+	return &c.LinkCursor, true
+}
+
+// parseListQuery reads the filters, sort and page of GET /links. sort is
+// the sort parameter as given, which the cursor is tied to.
+func parseListQuery(c echo.Context) (q store.LinkQuery, sort string, err error) {
+	var errs validationError
+	q = store.LinkQuery{
+		Owner:  c.QueryParam("owner"),
+		Tag:    strings.ToLower(c.QueryParam("tag")),
+		Domain: strings.ToLower(c.QueryParam("domain")),
+		Sort:   store.SortCreated,
+		Limit:  listDefaultLimit,
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"created_after", &q.CreatedAfter}, {"created_before", &q.CreatedBefore}} {
+		if v := c.QueryParam(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				errs.add(p.name, "must be an RFC 3339 timestamp")
+			}
+			*p.dst = t
+		}
+	}
+	switch q.Expiry = c.QueryParam("expiry"); q.Expiry {
+	case "", store.ExpiryPermanent, store.ExpiryExpiring, store.ExpiryExpired:
+	default:
+		errs.add("expiry", "expiry must be permanent, expiring or expired")
+	}
+
+	sort = c.QueryParam("sort")
+	if sort == "" {
+		sort = "-" + store.SortCreated
+	}
+	key, desc := strings.CutPrefix(sort, "-")
+	switch key {
+	case store.SortCreated, store.SortClicks:
+		q.Sort, q.Ascending = key, !desc
+	default:
+		errs.add("sort", "sort must be created_at or clicks, optionally prefixed with '-'")
+	}
+
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > listMaxLimit {
+			errs.add("limit", fmt.Sprintf("limit must be between 1 and %d", listMaxLimit))
+		}
+		q.Limit = n
+	}
+	if v := c.QueryParam("cursor"); v != "" {
+		cursor, ok := decodeCursor(v, sort)
+		if !ok {
+			errs.add("cursor", "cursor is invalid or belongs to another sort order")
+		}
+		q.After = cursor
+	}
+	return q, sort, errs.orNil()
+}
+
+// listLinks pages through links with a cursor, which stays stable while
+// links are added or removed, unlike an offset. Keys only see their own
+// links; admin keys see every link and may filter by owner.
+func (s *Server) listLinks(c echo.Context) error {
+	q, sort, err := parseListQuery(c)
+	if err != nil {
+		return invalidInput(c, err.(validationError))
+	}
+	if owner := scopeOwner(c); owner != "" {
+		if q.Owner != "" && q.Owner != owner {
+			return c.JSON(http.StatusForbidden, echo.Map{"error": "can only list links of your own API key"})
+		}
+		q.Owner = owner
+	}
+
+	// One extra link tells whether there is a next page.
+	limit := q.Limit
+	q.Limit++
+	ctx, cancel := opContext(c)
+	urls, err := s.Links.ListLinks(ctx, q)
+	cancel()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "DB lookup failed"})
+	}
+
+	res := echo.Map{"links": urls}
+	if len(urls) > limit {
+		urls = urls[:limit]
+		res["links"] = urls
+		res["next_cursor"] = encodeCursor(sort, urls[limit-1])
+	}
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"time"
+	"url-shortner/internal/config"
+	"url-shortner/internal/metrics"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+const filterCheckInterval = time.Minute
+
+// idPattern accepts every ID the service hands out, generated or alias.
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var errExpired = errors.New("link expired")
+
+func negativeKey(id string) string {
+	return "miss:" + id
+}
+
+// lookupURL resolves a cache miss. Malformed IDs, IDs the existence filter
+// has never seen and IDs recently found missing are answered without a
+// database round trip. Otherwise concurrent lookups of the same ID share a
+// single MongoDB query, and its result, found or not, is written to Redis.
+// It returns store.ErrNotFound, errExpired or store.ErrDeleted for links
+// that cannot be served.
+func (s *Server) lookupURL(c echo.Context, id string) (store.URL, error) {
+	if !idPattern.MatchString(id) {
+		metrics.LookupAvoided(metrics.AvoidedInvalidID)
+		return store.URL{}, store.ErrNotFound
+	}
+	if !s.mayExist(c, id) {
+		metrics.LookupAvoided(metrics.AvoidedFilter)
+		return store.URL{}, store.ErrNotFound
+	}
+	if err := s.knownMissing(c, id); err != nil {
+		metrics.LookupAvoided(metrics.AvoidedNegativeCache)
+		return store.URL{}, err
+	}
+
+	leader := false
+	v, err, shared := s.lookups.Do(id, func() (interface{}, error) {
+		leader = true
+		// Detached so that one client going away does not fail every
+		// request waiting on this lookup.
+		ctx, cancel := detachedContext(c)
+		url, err := s.Links.Get(ctx, id)
+		cancel()
+
+		ctx, cancel = detachedContext(c)
+		defer cancel()
+		switch {
+		case err == store.ErrNotFound, err == store.ErrDeleted:
+			s.cacheMissing(ctx, id, err)
+		case err != nil:
+		case url.Expired():
+			// Expired links are kept as tombstones until they are purged.
+			err = errExpired
+			s.cacheMissing(ctx, id, err)
+		case url.Pending():
+			// Looked up again on every request until it goes live.
+		default:
+			s.cacheURL(ctx, url)
+		}
+		return url, err
+	})
+	if shared && !leader {
+		metrics.LookupAvoided(metrics.AvoidedCoalesced)
+	}
+	url, _ := v.(store.URL)
+	return url, err
+}
+
+// mayExist consults the existence filter. It errs on the side of true: a
+// missing filter or a Redis error never turns a real link into a 404.
+func (s *Server) mayExist(c echo.Context, id string) bool {
+	if s.Filter == nil {
+		return true
+	}
+	ctx, cancel := opContext(c)
+	defer cancel()
+	ok, err := s.Filter.Test(ctx, id)
+	return ok || err != nil
+}
+
+// Negative cache values, saying why an ID does not resolve. Entries
+// written before the reason was recorded read as missing.
+const (
+	missingExpired = "expired"
+	missingDeleted = "deleted"
+)
+
+// knownMissing returns the lookup error remembered for id, or nil.
+func (s *Server) knownMissing(c echo.Context, id string) error {
+	if config.AppConfig.NegativeCacheTTL <= 0 {
+		return nil
+	}
+	ctx, cancel := opContext(c)
+	defer cancel()
+	b, err := s.Cache.Get(ctx, negativeKey(id))
+	if err != nil {
+		return nil
+	}
+	switch string(b) {
+	case missingExpired:
+		return errExpired
+	case missingDeleted:
+		return store.ErrDeleted
+	}
+	return store.ErrNotFound
+}
+
+// cacheMissing remembers for NEGATIVECACHETTL that id does not resolve and
+// why. Creating, patching or deleting the link drops the entry.
+func (s *Server) cacheMissing(ctx context.Context, id string, reason error) {
+	ttl := config.AppConfig.NegativeCacheTTL
+	if ttl <= 0 {
+		return
+	}
+	value := []byte{1}
+	switch reason {
+	case errExpired:
+		value = []byte(missingExpired)
+	case store.ErrDeleted:
+		value = []byte(missingDeleted)
+	}
+	s.Cache.Set(ctx, negativeKey(id), value, ttl)
+}
+
+// addToFilter must run before the links are inserted, so the filter never
+// rejects a stored link. If the update fails the filter is dropped until it
+// is rebuilt, since it can no longer be trusted.
+func (s *Server) addToFilter(c echo.Context, ids ...string) {
+	if s.Filter == nil || len(ids) == 0 {
+		return
+	}
+	ctx, cancel := detachedContext(c)
+	defer cancel()
+	if err := s.Filter.Add(ctx, ids...); err != nil {
+		if err != store.ErrCacheUnavailable {
+			log.Printf("adding IDs to the existence filter failed, invalidating it: %v", err)
+		}
+		s.Filter.Invalidate(ctx)
+	}
+}
+
+// RunFilterRefresher rebuilds the existence filter from the LinkStore when
+// it is missing or older than BLOOMREBUILDINTERVAL, checking once a minute
+// until ctx is cancelled.
+func (s *Server) RunFilterRefresher(ctx context.Context) {
+	if s.Filter == nil {
+		return
+	}
+	ticker := time.NewTicker(filterCheckInterval)
+	defer ticker.Stop()
+	for {
+		err := s.Filter.Refresh(ctx, config.AppConfig.BloomRebuildInterval, s.Links.EachID)
+		if err != nil && err != store.ErrCacheUnavailable && ctx.Err() == nil {
+			log.Printf("rebuilding the existence filter failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+// pages holds one template set per page, each combined with the shared
+// layout, since every page defines its own title and content blocks.
+var pages = map[string]*template.Template{}
+
+func init() {
+	names, err := templateFS.ReadDir("templates")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range names {
+		name := entry.Name()
+		if name == "layout.html" {
+			continue
+		}
+		pages[name] = template.Must(template.ParseFS(templateFS, "templates/layout.html", "templates/"+name))
+	}
+}
+
+// pagePolicy is the Content-Security-Policy of every page. Pages only contain
+// inline styles, so it forbids everything else, including being framed.
+const pagePolicy = "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'"
+
+// pagePolicies overrides pagePolicy for single pages. The password form is
+// answered with a redirect to the link's target, and browsers check that
+// redirect against form-action too, so the form's page must not restrict it.
+var pagePolicies = map[string]string{
+	"password.html": "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'",
+}
+
+// renderPage writes an HTML page with its Content-Security-Policy.
+func renderPage(c echo.Context, code int, name string, data interface{}) error {
+	var buf bytes.Buffer
+	if err := pages[name].ExecuteTemplate(&buf, "layout", data); err != nil {
+		log.Printf("rendering %s: %v", name, err)
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "could not render page"})
+	}
+	h := c.Response().Header()
+	policy, ok := pagePolicies[name]
+	if !ok {
+		policy = pagePolicy
+	}
+	h.Set("Content-Security-Policy", policy)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "no-referrer")
+	return c.HTMLBlob(code, buf.Bytes())
+}
+
+type previewPage struct {
+	ShortURL  string
+	Target    string
+	Host      string
+	CreatedAt time.Time
+	ExpireAt  *time.Time
+}
+
+// renderPreview shows where link goes and lets the visitor continue there
+// instead of being redirected.
+func renderPreview(c echo.Context, link store.URL) error {
+	page := previewPage{
+		ShortURL:  shortLink(c, link.ID),
+		Target:    link.Original,
+		CreatedAt: link.CreatedAt.UTC(),
+	}
+	if u, err := url.Parse(link.Original); err == nil {
+		page.Host = u.Hostname()
+	}
+	if link.ExpireAt != nil {
+		t := link.ExpireAt.UTC()
+		page.ExpireAt = &t
+	}
+	return renderPage(c, http.StatusOK, "preview.html", page)
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"url-shortner/internal/config"
+	"url-shortner/internal/metrics"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordMinLength = 6
+	// bcrypt ignores everything past 72 bytes.
+	passwordMaxLength = 72
+)
+
+func checkPassword(password string) string {
+	if len(password) < passwordMinLength || len(password) > passwordMaxLength {
+		return fmt.Sprintf("must be %d-%d bytes", passwordMinLength, passwordMaxLength)
+	}
+	return ""
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+type passwordPage struct {
+	ShortURL string
+	Action   string
+	Error    string
+}
+
+// renderPasswordForm asks for the password of link. The form posts back to
+// the URL it was served from, so a preview request stays a preview.
+func renderPasswordForm(c echo.Context, code int, link store.URL, msg string) error {
+	// Nothing about a protected link may be cached, or the redirect could
+	// be replayed without the password.
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return renderPage(c, code, "password.html", passwordPage{
+		ShortURL: shortLink(c, link.ID),
+		Action:   c.Request().URL.RequestURI(),
+		Error:    msg,
+	})
+}
+
+// unlockURL checks the password posted for a protected link and, if it
+// matches, continues as resolveURL would, counting the redirect the same
+// way. Failed attempts are throttled per link and per client IP, and only
+// counted as password attempts, since they resolve nothing.
+func (s *Server) unlockURL(c echo.Context) error {
+	id, preview := linkParam(c)
+	url, hit, err := s.findURL(c, id)
+	if err != nil {
+		return failRedirect(c, failureFor(err))
+	}
+	if url.Pending() {
+		metrics.Redirect(metrics.RedirectNotActive)
+		return notActive(c, url)
+	}
+	if !url.Protected() {
+		return c.Redirect(http.StatusSeeOther, c.Request().URL.RequestURI())
+	}
+
+	subjects := []passwordSubject{
+		{"link:" + id, config.AppConfig.PasswordFailuresLink},
+		{"ip:" + c.RealIP(), config.AppConfig.PasswordFailuresIP},
+	}
+	attempts, retry := s.reserveAttempt(c, subjects)
+	if retry > 0 {
+		metrics.PasswordAttempt(metrics.PasswordThrottled)
+		c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(retry.Seconds())))
+		msg := fmt.Sprintf("Too many wrong passwords. Try again in %d minutes.", int(retry.Minutes())+1)
+		return renderPasswordForm(c, http.StatusTooManyRequests, url, msg)
+	}
+
+	var form struct {
+		Password string `form:"password" json:"password"`
+	}
+	c.Bind(&form)
+	if bcrypt.CompareHashAndPassword([]byte(url.PasswordHash), []byte(form.Password)) != nil {
+		metrics.PasswordAttempt(metrics.PasswordFailure)
+		return renderPasswordForm(c, http.StatusForbidden, url, "Wrong password.")
+	}
+	metrics.PasswordAttempt(metrics.PasswordSuccess)
+	s.releaseAttempt(c, attempts)
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	if !preview || url.MaxClicks > 0 {
+		switch err := s.consumeClick(c, url); {
+		case err == store.ErrLimitReached:
+			return failRedirect(c, failExhausted)
+		case err != nil:
+			return failRedirect(c, failUncounted)
+		}
+		s.recordClick(c, id)
+	}
+	if hit {
+		metrics.Redirect(metrics.RedirectHit)
+	} else {
+		metrics.Redirect(metrics.RedirectMiss)
+	}
+	if preview || url.Interstitial {
+		return renderPreview(c, url)
+	}
+	// 303 makes the browser follow with a GET whatever the link's code.
+	return c.Redirect(http.StatusSeeOther, url.Original)
+}
+
+// passwordSubject is something attempts are counted against, with the
+// number of wrong passwords allowed per PASSWORDFAILUREWINDOW. A limit of 0
+// disables it.
+type passwordSubject struct {
+	key   string
+	limit int
+}
+
+func passwordWindowKey(subject string) string {
+	return "pwfail:" + subject
+}
+
+// passwordAttempt is an attempt counted against one subject.
+type passwordAttempt struct {
+	key   string
+	token string
+}
+
+// reserveAttempt counts an attempt against every subject before the
+// password is compared, so concurrent guesses cannot all get in before the
+// first failure is recorded. It returns the counted attempts, which
+// releaseAttempt takes back when the password is right, or how long until
+// the password may be tried again. Like the rate limiter, it fails open
+// when Redis is unavailable.
+func (s *Server) reserveAttempt(c echo.Context, subjects []passwordSubject) ([]passwordAttempt, time.Duration) {
+	ctx, cancel := opContext(c)
+	defer cancel()
+	window := config.AppConfig.PasswordFailureWindow
+	var attempts []passwordAttempt
+	var wait time.Duration
+	for _, sub := range subjects {
+		if sub.limit <= 0 {
+			continue
+		}
+		key := passwordWindowKey(sub.key)
+		res, err := s.Cache.SlidingWindow(ctx, key, sub.limit, window)
+		if err != nil {
+			if err != store.ErrCacheUnavailable {
+				log.Printf("password throttle unavailable, allowing attempt: %v", err)
+			}
+			continue
+		}
+		if !res.Allowed {
+			wait = max(wait, res.Reset)
+			continue
+		}
+		attempts = append(attempts, passwordAttempt{key, res.Token})
+	}
+	if wait > 0 {
+		// A refused attempt does not count against the other subjects.
+		s.releaseAttempt(c, attempts)
+		return nil, wait
+	}
+	return attempts, 0
+}
+
+// releaseAttempt takes back attempts that turned out not to be failures.
+func (s *Server) releaseAttempt(c echo.Context, attempts []passwordAttempt) {
+	ctx, cancel := detachedContext(c)
+	defer cancel()
+	for _, a := range attempts {
+		s.Cache.Uncount(ctx, a.key, a.token)
+	}
+}
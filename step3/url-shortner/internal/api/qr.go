@@ -0,0 +1,243 @@
+package api
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	qrDefaultSize   = 256
+	qrMinSize       = 32
+	qrMaxSize       = 4096
+	qrDefaultMargin = 4
+	qrMaxMargin     = 32
+)
+
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// qrOptions are the rendering parameters of GET /:hsh/qr.
+type qrOptions struct {
+	format string
+	size   int // width and height in pixels
+	margin int // quiet zone in modules
+	level  string
+	fg, bg color.NRGBA
+}
+
+// parseQROptions reads the query parameters, applying defaults for the ones
+// that are missing.
+func parseQROptions(c echo.Context) (qrOptions, error) {
+	opts := qrOptions{
+		format: "png",
+		size:   qrDefaultSize,
+		margin: qrDefaultMargin,
+		level:  "M",
+		fg:     color.NRGBA{A: 0xff},
+		bg:     color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	}
+	var errs validationError
+
+	if v := c.QueryParam("format"); v != "" {
+		opts.format = strings.ToLower(v)
+		if opts.format != "png" && opts.format != "svg" {
+			errs.add("format", "format must be png or svg")
+		}
+	}
+	if v := c.QueryParam("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < qrMinSize || n > qrMaxSize {
+			errs.add("size", fmt.Sprintf("size must be between %d and %d pixels", qrMinSize, qrMaxSize))
+		}
+		opts.size = n
+	}
+	if v := c.QueryParam("margin"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > qrMaxMargin {
+			errs.add("margin", fmt.Sprintf("margin must be between 0 and %d modules", qrMaxMargin))
+		}
+		opts.margin = n
+	}
+	if v := c.QueryParam("ec"); v != "" {
+		opts.level = strings.ToUpper(v)
+		if _, ok := qrLevels[opts.level]; !ok {
+			errs.add("ec", "ec must be L, M, Q or H")
+		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  *color.NRGBA
+	}{{"fg", &opts.fg}, {"bg", &opts.bg}} {
+		if v := c.QueryParam(p.name); v != "" {
+			col, err := parseHexColor(v)
+			if err != nil {
+				errs.add(p.name, err.Error())
+			}
+			*p.dst = col
+		}
+	}
+	return opts, errs.orNil()
+}
+
+// parseHexColor accepts CSS hex colors: RGB, RGBA, RRGGBB or RRGGBBAA,
+// with or without a leading '#'.
+func parseHexColor(s string) (color.NRGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) == 3 || len(s) == 4 {
+		long := make([]byte, 0, 2*len(s))
+		for i := 0; i < len(s); i++ {
+			long = append(long, s[i], s[i])
+		}
+		s = string(long)
+	}
+	if len(s) == 6 {
+		s += "ff"
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return color.NRGBA{}, errors.New("color must be hex RGB, RGBA, RRGGBB or RRGGBBAA")
+	}
+	return color.NRGBA{R: b[0], G: b[1], B: b[2], A: b[3]}, nil
+}
+
+// etag identifies the image for url rendered with opts. The content also
+// depends on the short URL, which includes the host the request came in on.
+func (o qrOptions) etag(url store.URL, content string) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%s|%d|%d|%s|%v|%v", content, o.format, o.size, o.margin, o.level, o.fg, o.bg)
+	return fmt.Sprintf(`"%s.%d.%x"`, url.ID, url.Version, h.Sum64())
+}
+
+// linkQR renders the short URL of a link as a QR code. The image only
+// changes with the link's ID, version and the rendering options, so it is
+// served with an ETag and honours If-None-Match.
+func (s *Server) linkQR(c echo.Context) error {
+	id := c.Param("hsh")
+
+	opts, err := parseQROptions(c)
+	if err != nil {
+		return invalidInput(c, err.(validationError))
+	}
+
+	url, _, err := s.findURL(c, id)
+	if err != nil {
+		return respondFailure(c, failureFor(err))
+	}
+
+	content := shortLink(c, url.ID)
+	etag := opts.etag(url, content)
+	c.Response().Header().Set("ETag", etag)
+	setRedirectCaching(c, url)
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	code, err := qrcode.New(content, qrLevels[opts.level])
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "could not encode QR code"})
+	}
+	code.DisableBorder = true
+	modules := code.Bitmap()
+
+	if opts.format == "svg" {
+		return c.Blob(http.StatusOK, "image/svg+xml", renderQRSVG(modules, opts))
+	}
+	b, err := renderQRPNG(modules, opts)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "could not render QR code"})
+	}
+	return c.Blob(http.StatusOK, "image/png", b)
+}
+
+// etagMatches implements the weak comparison If-None-Match calls for.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// renderQRPNG scales the modules by a whole number of pixels so their edges
+// stay sharp, and centres the code in an image of opts.size pixels. Codes
+// with more modules than that get one pixel per module.
+func renderQRPNG(modules [][]bool, opts qrOptions) ([]byte, error) {
+	n := len(modules) + 2*opts.margin
+	scale := max(opts.size/n, 1)
+	side := max(opts.size, n)
+	offset := (side-n*scale)/2 + opts.margin*scale
+
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{opts.bg, opts.fg})
+	for y, row := range modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderQRSVG draws each horizontal run of dark modules as one rectangle in
+// a single path, in module units scaled to opts.size by the viewBox.
+func renderQRSVG(modules [][]bool, opts qrOptions) []byte {
+	n := len(modules) + 2*opts.margin
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		opts.size, opts.size, n, n)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" %s/>`, n, n, svgFill(opts.bg))
+	fmt.Fprintf(&b, `<path %s d="`, svgFill(opts.fg))
+	for y, row := range modules {
+		for x := 0; x < len(row); {
+			if !row[x] {
+				x++
+				continue
+			}
+			run := 1
+			for x+run < len(row) && row[x+run] {
+				run++
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv1h-%dz", x+opts.margin, y+opts.margin, run, run)
+			x += run
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.Bytes()
+}
+
+func svgFill(c color.NRGBA) string {
+	fill := fmt.Sprintf(`fill="#%02x%02x%02x"`, c.R, c.G, c.B)
+	if c.A != 0xff {
+		fill += fmt.Sprintf(` fill-opacity="%.3g"`, float64(c.A)/0xff)
+	}
+	return fill
+}
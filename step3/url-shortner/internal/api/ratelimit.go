@@ -0,0 +1,116 @@
+package api
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"url-shortner/internal/config"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+// rateLimit limits route per API key when the request carries one and per
+// client IP otherwise. It must run after authenticate. Limits of 0 disable
+// limiting, and Redis errors fail open so the limiter never takes the
+// service down with it.
+func (s *Server) rateLimit(route string, ipLimit int) echo.MiddlewareFunc {
+	allowlist := parseAllowlist(config.AppConfig.RateLimitAllowlist)
+	window := config.AppConfig.RateLimitWindow
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ip := net.ParseIP(c.RealIP())
+			if allowlisted(allowlist, ip) {
+				return next(c)
+			}
+
+			subject, limit := "ip:"+c.RealIP(), ipLimit
+			if key := apiKeyOf(c); key != nil {
+				subject, limit = "key:"+key.Hash, config.AppConfig.RateLimitAPIKey
+				if key.RateLimit > 0 {
+					limit = key.RateLimit
+				}
+			}
+			if limit <= 0 {
+				return next(c)
+			}
+
+			ctx, cancel := opContext(c)
+			res, err := s.Cache.SlidingWindow(ctx, "ratelimit:"+route+":"+subject, limit, window)
+			cancel()
+			if err != nil {
+				if err != store.ErrCacheUnavailable {
+					log.Printf("rate limiter unavailable, allowing request: %v", err)
+				}
+				return next(c)
+			}
+			reset := strconv.FormatInt(int64((res.Reset+time.Second-1)/time.Second), 10)
+
+			h := c.Response().Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(max(0, limit-res.Count)))
+			h.Set("RateLimit-Reset", reset)
+			if !res.Allowed {
+				h.Set(echo.HeaderRetryAfter, reset)
+				return c.JSON(http.StatusTooManyRequests, echo.Map{"error": "rate limit exceeded"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// ipExtractor decides what c.RealIP returns. X-Forwarded-For is only read
+// when the request comes from one of the trusted proxies, since any client
+// can send it; without trusted proxies the peer address is used.
+func ipExtractor(proxies []string) echo.IPExtractor {
+	nets := parseNets(proxies, "trusted proxy")
+	if len(nets) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	opts := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, n := range nets {
+		opts = append(opts, echo.TrustIPRange(n))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...)
+}
+
+func parseAllowlist(entries []string) []*net.IPNet {
+	return parseNets(entries, "rate limit allowlist")
+}
+
+// parseNets reads IPs and CIDRs, logging and skipping invalid entries.
+func parseNets(entries []string, what string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("ignoring invalid %s entry %q", what, entry)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func allowlisted(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+	"time"
+	"url-shortner/internal/config"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Values of NOTACTIVERESPONSE.
+const (
+	notActivePage     = "page"
+	notActiveNotFound = "notfound"
+)
+
+// parseActivateAt reads an RFC 3339 activation time. Times in the past are
+// accepted and simply make the link live straight away.
+func parseActivateAt(s string) (*time.Time, string) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, "must be an RFC 3339 timestamp"
+	}
+	t = t.UTC()
+	return &t, ""
+}
+
+// checkSchedule reports a patch that would leave current activating at or
+// after it expires, the rule validateShorten applies to new links.
+func checkSchedule(current store.URL, patch store.LinkPatch) error {
+	activateAt, expireAt := current.ActivateAt, current.ExpireAt
+	if patch.SetActivateAt {
+		activateAt = patch.ActivateAt
+	}
+	if patch.SetExpireAt {
+		expireAt = patch.ExpireAt
+	}
+	if activateAt == nil || expireAt == nil || activateAt.Before(*expireAt) {
+		return nil
+	}
+	var errs validationError
+	if patch.SetActivateAt {
+		errs.add("activate_at", "must be before the link expires")
+	} else {
+		errs.add("expire", "must be after the link activates")
+	}
+	return errs
+}
+
+type notActivePageData struct {
+	ShortURL   string
+	ActivateAt time.Time
+}
+
+// notActive answers for a link before its ActivateAt: a temporary redirect
+// to its fallback URL if it has one, otherwise whatever NOTACTIVERESPONSE
+// selects. Either way the status is 404: there is nothing at the link yet.
+// Nothing is cached, since the answer changes at activation.
+func notActive(c echo.Context, url store.URL) error {
+	c.Response().Header().Set("Cache-Control", "no-store")
+	if url.FallbackURL != "" {
+		return c.Redirect(http.StatusFound, url.FallbackURL)
+	}
+	if config.AppConfig.NotActiveResponse == notActiveNotFound {
+		return respondFailure(c, failNotFound)
+	}
+	return renderPage(c, http.StatusNotFound, "notactive.html", notActivePageData{
+		ShortURL:   shortLink(c, url.ID),
+		ActivateAt: url.ActivateAt.UTC(),
+	})
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"fmt"
+	"time"
+	"url-shortner/internal/config"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ttlPolicy bounds link lifetimes. A zero Default means links never expire
+// unless asked to; a zero Max means there is no upper bound.
+type ttlPolicy struct {
+	Default time.Duration
+	Max     time.Duration
+}
+
+// policyFor returns the service-wide policy, overridden by the caller's API
+// key where it sets its own values. A negative key max lifts the limit.
+func policyFor(c echo.Context) ttlPolicy {
+	p := ttlPolicy{Default: config.AppConfig.DefaultTTL, Max: config.AppConfig.MaxTTL}
+	if key := apiKeyOf(c); key != nil {
+		if key.DefaultTTL > 0 {
+			p.Default = time.Duration(key.DefaultTTL) * time.Minute
+		}
+		if key.MaxTTL > 0 {
+			p.Max = time.Duration(key.MaxTTL) * time.Minute
+		} else if key.MaxTTL < 0 {
+			p.Max = 0
+		}
+	}
+	return p
+}
+
+// resolve turns a requested expiry in minutes into a lifetime, where 0 means
+// the link never expires. A nil expire selects the default. The returned
+// message is non-empty when the request breaks the policy.
+func (p ttlPolicy) resolve(expire *int) (time.Duration, string) {
+	var ttl time.Duration
+	switch {
+	case expire == nil:
+		ttl = p.Default
+		if ttl == 0 || (p.Max > 0 && ttl > p.Max) {
+			ttl = p.Max
+		}
+		return ttl, ""
+	case *expire < 0:
+		return 0, "must not be negative"
+	default:
+		ttl = time.Duration(*expire) * time.Minute
+	}
+
+	if p.Max > 0 && (ttl == 0 || ttl > p.Max) {
+		return 0, fmt.Sprintf("must be between 1 and %d minutes", int(p.Max.Minutes()))
+	}
+	return ttl, ""
+}
+
+// expiryFor returns the expire_at value for a lifetime, nil for never.
+func expiryFor(ttl time.Duration) *time.Time {
+	if ttl <= 0 {
+		return nil
+	}
+	t := time.Now().Add(ttl)
+	return &t
+}
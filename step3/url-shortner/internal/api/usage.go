@@ -0,0 +1,90 @@
+package api
+
+import (
+	"log"
+	"strconv"
+	"url-shortner/internal/store"
+
+	"github.com/labstack/echo/v4"
+)
+
+func usageKey(id string) string {
+	return "usage:" + id
+}
+
+// consumeClick uses up one click of a link with MaxClicks, returning
+// store.ErrLimitReached once none are left. Redis holds the authoritative
+// counter, so the limit check is a single atomic script that every replica
+// agrees on. It is seeded from the link's Used count when missing, and each
+// increment is copied back into MongoDB before the click is allowed, so a
+// lost counter is reseeded from an up-to-date count. When Redis cannot
+// answer, MongoDB enforces the limit itself and the Redis counter is
+// dropped so it is reseeded later.
+func (s *Server) consumeClick(c echo.Context, url store.URL) error {
+	if url.MaxClicks <= 0 {
+		return nil
+	}
+	ctx, cancel := detachedContext(c)
+	defer cancel()
+
+	max := int64(url.MaxClicks)
+	ttl, _ := url.Remaining()
+	used, err := s.Cache.IncrBounded(ctx, usageKey(url.ID), max, nil, ttl)
+	if err == store.ErrCacheMiss {
+		// The cached link may be behind, so seed from a fresh read.
+		var fresh store.URL
+		if fresh, err = s.Links.Get(ctx, url.ID); err == store.ErrNotFound || err == store.ErrDeleted {
+			return store.ErrLimitReached
+		} else if err != nil {
+			return err
+		}
+		seed := int64(fresh.Used)
+		used, err = s.Cache.IncrBounded(ctx, usageKey(url.ID), max, &seed, ttl)
+	}
+	switch {
+	case err == store.ErrLimitReached:
+		return err
+	case err != nil:
+		if _, err := s.Links.ConsumeClick(ctx, url.ID); err != nil {
+			return err
+		}
+		s.Cache.Del(ctx, usageKey(url.ID))
+		return nil
+	}
+	if err := s.Links.SyncUsage(ctx, url.ID, int(used)); err != nil {
+		log.Printf("syncing click usage of %s failed: %v", url.ID, err)
+	}
+	return nil
+}
+
+// checkClicksLeft returns store.ErrLimitReached if a link with MaxClicks has
+// no clicks left, without using one. It is for requests that reveal the
+// target without following it, such as HEAD.
+func (s *Server) checkClicksLeft(c echo.Context, url store.URL) error {
+	if url.MaxClicks <= 0 {
+		return nil
+	}
+	ctx, cancel := opContext(c)
+	defer cancel()
+
+	if b, err := s.Cache.Get(ctx, usageKey(url.ID)); err == nil {
+		if used, err := strconv.Atoi(string(b)); err == nil {
+			return limitReached(used, url.MaxClicks)
+		}
+	}
+	// Without a counter MongoDB's count is the latest one.
+	fresh, err := s.Links.Get(ctx, url.ID)
+	if err == store.ErrNotFound || err == store.ErrDeleted {
+		return store.ErrLimitReached
+	} else if err != nil {
+		return err
+	}
+	return limitReached(fresh.Used, fresh.MaxClicks)
+}
+
+func limitReached(used, max int) error {
+	if used >= max {
+		return store.ErrLimitReached
+	}
+	return nil
+}
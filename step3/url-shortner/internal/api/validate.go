@@ -0,0 +1,376 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"url-shortner/internal/config"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/labstack/echo/v4"
+)
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError collects every problem with a request so clients can fix
+// them in one round trip.
+type validationError []fieldError
+
+func (v validationError) Error() string {
+	msgs := make([]string, len(v))
+	for i, fe := range v {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (v *validationError) add(field, msg string) {
+	*v = append(*v, fieldError{Field: field, Message: msg})
+}
+
+func (v validationError) orNil() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+func invalidInput(c echo.Context, err validationError) error {
+	return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid input", "fields": err})
+}
+
+// validateShorten checks req, normalizes req.URL in place and resolves its
+// lifetime under policy. selfHost is the Host the request arrived on, which
+// is always treated as our own.
+func validateShorten(req *shortenRequest, selfHost string, policy ttlPolicy) error {
+	var errs validationError
+
+	if target, msg := normalizeTarget(req.URL, selfHost); msg != "" {
+		errs.add("url", msg)
+	} else {
+		req.URL = target
+	}
+	if req.Alias != "" {
+		if err := validateAlias(req.Alias); err != nil {
+			errs.add("alias", err.Error())
+		}
+	}
+	if ttl, msg := policy.resolve(req.Expire); msg != "" {
+		errs.add("expire", msg)
+	} else {
+		req.ttl = ttl
+	}
+	if req.Redirect != 0 && !validRedirectCode(req.Redirect) {
+		errs.add("redirect", "must be one of 301, 302, 307 or 308")
+	}
+	if req.MaxClicks < 0 {
+		errs.add("max_clicks", "must not be negative")
+	}
+	if req.ActivateAt != "" {
+		if t, msg := parseActivateAt(req.ActivateAt); msg != "" {
+			errs.add("activate_at", msg)
+		} else if req.ttl > 0 && !t.Before(time.Now().Add(req.ttl)) {
+			errs.add("activate_at", "must be before the link expires")
+		} else {
+			req.activateAt = t
+		}
+	}
+	if req.FallbackURL != "" {
+		if target, msg := normalizeTarget(req.FallbackURL, selfHost); msg != "" {
+			errs.add("fallback_url", msg)
+		} else {
+			req.FallbackURL = target
+		}
+	}
+	if tags, msg := normalizeTags(req.Tags); msg != "" {
+		errs.add("tags", msg)
+	} else {
+		req.Tags = tags
+	}
+	if req.Password != "" {
+		if msg := checkPassword(req.Password); msg != "" {
+			errs.add("password", msg)
+		} else if len(errs) == 0 {
+			// Hashing is slow on purpose, so only do it for valid requests.
+			hash, err := hashPassword(req.Password)
+			if err != nil {
+				errs.add("password", "could not be hashed")
+			}
+			req.passwordHash = hash
+		}
+	}
+	return errs.orNil()
+}
+
+// validatePatch checks req and normalizes req.URL in place.
+func validatePatch(req *patchRequest, selfHost string, policy ttlPolicy) error {
+	var errs validationError
+
+	if req.Version == nil {
+		errs.add("version", "is required")
+	}
+	if req.URL != nil {
+		if target, msg := normalizeTarget(*req.URL, selfHost); msg != "" {
+			errs.add("url", msg)
+		} else {
+			req.URL = &target
+		}
+	}
+	if req.Expire != nil {
+		if _, msg := policy.resolve(req.Expire); msg != "" {
+			errs.add("expire", msg)
+		}
+	}
+	if req.Redirect != nil && *req.Redirect != 0 && !validRedirectCode(*req.Redirect) {
+		errs.add("redirect", "must be one of 301, 302, 307 or 308")
+	}
+	if req.Password != nil && *req.Password != "" {
+		if msg := checkPassword(*req.Password); msg != "" {
+			errs.add("password", msg)
+		}
+	}
+	if req.MaxClicks != nil && *req.MaxClicks < 0 {
+		errs.add("max_clicks", "must not be negative")
+	}
+	if req.ActivateAt != nil && *req.ActivateAt != "" {
+		if t, msg := parseActivateAt(*req.ActivateAt); msg != "" {
+			errs.add("activate_at", msg)
+		} else {
+			req.activateAt = t
+		}
+	}
+	if req.FallbackURL != nil && *req.FallbackURL != "" {
+		if target, msg := normalizeTarget(*req.FallbackURL, selfHost); msg != "" {
+			errs.add("fallback_url", msg)
+		} else {
+			req.FallbackURL = &target
+		}
+	}
+	if req.Tags != nil {
+		if tags, msg := normalizeTags(*req.Tags); msg != "" {
+			errs.add("tags", msg)
+		} else {
+			req.Tags = &tags
+		}
+	}
+	if req.URL == nil && req.Expire == nil && req.Redirect == nil && req.Interstitial == nil &&
+		req.Password == nil && req.MaxClicks == nil && req.ActivateAt == nil && req.FallbackURL == nil && req.Tags == nil {
+		errs.add("body", "nothing to update")
+	}
+	if req.Password != nil && len(errs) == 0 {
+		hash := ""
+		if *req.Password != "" {
+			var err error
+			if hash, err = hashPassword(*req.Password); err != nil {
+				errs.add("password", "could not be hashed")
+			}
+		}
+		req.passwordHash = &hash
+	}
+	return errs.orNil()
+}
+
+// normalizeTags lowercases tags and drops duplicates, or returns a message
+// saying why they are not accepted.
+func normalizeTags(tags []string) ([]string, string) {
+	if len(tags) > maxTags {
+		return nil, fmt.Sprintf("at most %d tags are allowed", maxTags)
+	}
+	out := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !tagPattern.MatchString(tag) {
+			return nil, "tags must be 1-32 characters of letters, digits, '-' or '_'"
+		}
+		if !slices.Contains(out, tag) {
+			out = append(out, tag)
+		}
+	}
+	return out, ""
+}
+
+// normalizeTarget returns the canonical form of raw, or a message saying
+// why it cannot be shortened.
+func normalizeTarget(raw, selfHost string) (string, string) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", "is required"
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "is not a valid URL"
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if !schemeAllowed(u.Scheme) {
+		return "", "scheme must be one of " + strings.Join(config.AppConfig.AllowedSchemes, ", ")
+	}
+	if u.Opaque != "" || u.Host == "" {
+		return "", "must be an absolute URL with a host"
+	}
+	if u.User != nil {
+		return "", "must not contain credentials"
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+
+	if isSelfHost(host, selfHost) {
+		return "", "must not point back to this service"
+	}
+	if domainBlocklist.blocked(host) {
+		return "", "domain is blocked"
+	}
+	return u.String(), ""
+}
+
+func validRedirectCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+func schemeAllowed(scheme string) bool {
+	for _, s := range config.AppConfig.AllowedSchemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSelfHost(host, requestHost string) bool {
+	if h, _, err := net.SplitHostPort(requestHost); err == nil {
+		requestHost = h
+	}
+	if strings.EqualFold(host, requestHost) {
+		return true
+	}
+	for _, self := range config.AppConfig.SelfHosts {
+		if strings.EqualFold(host, self) {
+			return true
+		}
+	}
+	return false
+}
+
+type blocklist struct {
+	mu      sync.RWMutex
+	domains map[string]struct{}
+}
+
+var domainBlocklist = &blocklist{}
+
+// blocked reports whether host or any of its parent domains is listed.
+func (b *blocklist) blocked(host string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.domains) == 0 {
+		return false
+	}
+	for {
+		if _, ok := b.domains[host]; ok {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+// load replaces the list with the domains in path, one per line. Blank
+// lines and lines starting with '#' are ignored.
+func (b *blocklist) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	domains := make(map[string]struct{})
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.ToLower(strings.TrimSpace(sc.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains[strings.TrimSuffix(strings.TrimPrefix(line, "*."), ".")] = struct{}{}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.domains = domains
+	b.mu.Unlock()
+	return nil
+}
+
+// WatchBlocklist loads the domain blocklist from path and reloads it
+// whenever the file changes until ctx is cancelled. The parent directory is
+// watched rather than the file so atomic replaces, including Kubernetes
+// ConfigMap symlink swaps, are picked up.
+func WatchBlocklist(ctx context.Context, path string) error {
+	if err := domainBlocklist.load(path); err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-watcher.Events:
+				if ev.Has(fsnotify.Chmod) {
+					continue
+				}
+				if err := domainBlocklist.load(path); err != nil {
+					log.Printf("reloading blocklist %s failed, keeping previous list: %v", path, err)
+					continue
+				}
+				log.Printf("reloaded blocklist %s", path)
+			case err := <-watcher.Errors:
+				log.Printf("watching blocklist %s: %v", path, err)
+			}
+		}
+	}()
+	return nil
+}
@@ -1,6 +1,9 @@
 package config
 
 import (
+	"strings"
+	"time"
+
 	"github.com/spf13/viper"
 )
 
@@ -10,6 +13,68 @@ type Config struct {
 	MongoDatabase   string
 	RedisHost       string
 	MongoCollection string
+	ClickCollection string
+	BatchMaxSize    int
+	BatchMaxBody    string
+	KeyCollection   string
+	AdminAPIKey     string
+
+	MigrationCollection string
+
+	IDStrategy string
+	IDLength   int
+	IDAlphabet string
+	IDSecret   string
+	IDNode     int
+	IDRetries  int
+
+	RateLimitWindow    time.Duration
+	RateLimitShorten   int
+	RateLimitRedirect  int
+	RateLimitAPIKey    int
+	RateLimitAllowlist []string
+
+	TrustedProxies []string
+
+	PasswordFailuresIP    int
+	PasswordFailuresLink  int
+	PasswordFailureWindow time.Duration
+
+	AllowedSchemes []string
+	SelfHosts      []string
+	BlocklistFile  string
+
+	DefaultRedirectCode int
+	RedirectMaxAge      time.Duration
+	NotActiveResponse   string
+
+	DefaultTTL time.Duration
+	MaxTTL     time.Duration
+	CacheTTL   time.Duration
+
+	TombstoneRetention time.Duration
+
+	CacheBreakerFailures int
+	CacheBreakerCooldown time.Duration
+
+	NegativeCacheTTL     time.Duration
+	BloomBits            uint64
+	BloomHashes          int
+	BloomRebuildInterval time.Duration
+
+	ServiceName        string
+	TracingExporter    string
+	TracingSampleRatio float64
+	OTLPEndpoint       string
+	OTLPInsecure       bool
+
+	MetricsPort         string
+	ActiveLinksInterval time.Duration
+
+	OpTimeout       time.Duration
+	HealthTimeout   time.Duration
+	ShutdownDelay   time.Duration
+	ShutdownTimeout time.Duration
 }
 
 var AppConfig Config
@@ -20,12 +85,102 @@ func LoadConfig() {
 	viper.SetDefault("REDISHOST", "localhost")
 	viper.SetDefault("MONGODATABASE", "urlshortener")
 	viper.SetDefault("MONGOCOLLECTION", "urls")
+	viper.SetDefault("CLICKCOLLECTION", "clicks")
+	viper.SetDefault("BATCHMAXSIZE", 1000)
+	viper.SetDefault("BATCHMAXBODY", "4M")
+	viper.SetDefault("KEYCOLLECTION", "api_keys")
+	viper.SetDefault("MIGRATIONCOLLECTION", "migrations")
+	viper.SetDefault("IDSTRATEGY", "random")
+	viper.SetDefault("IDLENGTH", 7)
+	viper.SetDefault("IDALPHABET", "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
+	viper.SetDefault("IDNODE", -1)
+	viper.SetDefault("IDRETRIES", 3)
+	viper.SetDefault("RATELIMITWINDOW", "1m")
+	viper.SetDefault("RATELIMITSHORTEN", 60)
+	viper.SetDefault("RATELIMITREDIRECT", 600)
+	viper.SetDefault("RATELIMITAPIKEY", 600)
+	viper.SetDefault("PASSWORDFAILURESIP", 5)
+	viper.SetDefault("PASSWORDFAILURESLINK", 20)
+	viper.SetDefault("PASSWORDFAILUREWINDOW", "15m")
+	viper.SetDefault("ALLOWEDSCHEMES", "http,https")
+	viper.SetDefault("DEFAULTREDIRECTCODE", 302)
+	viper.SetDefault("REDIRECTMAXAGE", "1h")
+	viper.SetDefault("NOTACTIVERESPONSE", "page")
+	viper.SetDefault("DEFAULTTTL", "0")
+	viper.SetDefault("MAXTTL", "0")
+	viper.SetDefault("CACHETTL", "24h")
+	viper.SetDefault("TOMBSTONERETENTION", "168h")
+	viper.SetDefault("CACHEBREAKERFAILURES", 5)
+	viper.SetDefault("CACHEBREAKERCOOLDOWN", "10s")
+	viper.SetDefault("NEGATIVECACHETTL", "30s")
+	viper.SetDefault("BLOOMBITS", 1<<24)
+	viper.SetDefault("BLOOMHASHES", 7)
+	viper.SetDefault("BLOOMREBUILDINTERVAL", "24h")
+	viper.SetDefault("SERVICENAME", "url-shortner")
+	viper.SetDefault("TRACINGEXPORTER", "none")
+	viper.SetDefault("TRACINGSAMPLERATIO", 1.0)
+	viper.SetDefault("OTLPENDPOINT", "localhost:4318")
+	viper.SetDefault("OTLPINSECURE", true)
+	viper.SetDefault("METRICSPORT", 9090)
+	viper.SetDefault("ACTIVELINKSINTERVAL", "1m")
+	viper.SetDefault("OPTIMEOUT", "2s")
+	viper.SetDefault("HEALTHTIMEOUT", "1s")
+	viper.SetDefault("SHUTDOWNDELAY", "5s")
+	viper.SetDefault("SHUTDOWNTIMEOUT", "20s")
 
 	viper.BindEnv("PORT")
 	viper.BindEnv("MONGOHOST")
 	viper.BindEnv("REDISHOST")
 	viper.BindEnv("MONGODATABASE")
 	viper.BindEnv("MONGOCOLLECTION")
+	viper.BindEnv("CLICKCOLLECTION")
+	viper.BindEnv("BATCHMAXSIZE")
+	viper.BindEnv("BATCHMAXBODY")
+	viper.BindEnv("KEYCOLLECTION")
+	viper.BindEnv("ADMINAPIKEY")
+	viper.BindEnv("MIGRATIONCOLLECTION")
+	viper.BindEnv("IDSTRATEGY")
+	viper.BindEnv("IDLENGTH")
+	viper.BindEnv("IDALPHABET")
+	viper.BindEnv("IDSECRET")
+	viper.BindEnv("IDNODE")
+	viper.BindEnv("IDRETRIES")
+	viper.BindEnv("RATELIMITWINDOW")
+	viper.BindEnv("RATELIMITSHORTEN")
+	viper.BindEnv("RATELIMITREDIRECT")
+	viper.BindEnv("RATELIMITAPIKEY")
+	viper.BindEnv("RATELIMITALLOWLIST")
+	viper.BindEnv("TRUSTEDPROXIES")
+	viper.BindEnv("PASSWORDFAILURESIP")
+	viper.BindEnv("PASSWORDFAILURESLINK")
+	viper.BindEnv("PASSWORDFAILUREWINDOW")
+	viper.BindEnv("ALLOWEDSCHEMES")
+	viper.BindEnv("SELFHOSTS")
+	viper.BindEnv("BLOCKLISTFILE")
+	viper.BindEnv("DEFAULTREDIRECTCODE")
+	viper.BindEnv("REDIRECTMAXAGE")
+	viper.BindEnv("NOTACTIVERESPONSE")
+	viper.BindEnv("DEFAULTTTL")
+	viper.BindEnv("MAXTTL")
+	viper.BindEnv("CACHETTL")
+	viper.BindEnv("TOMBSTONERETENTION")
+	viper.BindEnv("CACHEBREAKERFAILURES")
+	viper.BindEnv("CACHEBREAKERCOOLDOWN")
+	viper.BindEnv("NEGATIVECACHETTL")
+	viper.BindEnv("BLOOMBITS")
+	viper.BindEnv("BLOOMHASHES")
+	viper.BindEnv("BLOOMREBUILDINTERVAL")
+	viper.BindEnv("SERVICENAME")
+	viper.BindEnv("TRACINGEXPORTER")
+	viper.BindEnv("TRACINGSAMPLERATIO")
+	viper.BindEnv("OTLPENDPOINT")
+	viper.BindEnv("OTLPINSECURE")
+	viper.BindEnv("METRICSPORT")
+	viper.BindEnv("ACTIVELINKSINTERVAL")
+	viper.BindEnv("OPTIMEOUT")
+	viper.BindEnv("HEALTHTIMEOUT")
+	viper.BindEnv("SHUTDOWNDELAY")
+	viper.BindEnv("SHUTDOWNTIMEOUT")
 
 	AppConfig = Config{
 		Port:            viper.GetString("PORT"),
@@ -33,5 +188,78 @@ func LoadConfig() {
 		RedisHost:       viper.GetString("REDISHOST"),
 		MongoDatabase:   viper.GetString("MONGODATABASE"),
 		MongoCollection: viper.GetString("MONGOCOLLECTION"),
+		ClickCollection: viper.GetString("CLICKCOLLECTION"),
+		BatchMaxSize:    viper.GetInt("BATCHMAXSIZE"),
+		BatchMaxBody:    viper.GetString("BATCHMAXBODY"),
+		KeyCollection:   viper.GetString("KEYCOLLECTION"),
+		AdminAPIKey:     viper.GetString("ADMINAPIKEY"),
+
+		MigrationCollection: viper.GetString("MIGRATIONCOLLECTION"),
+
+		IDStrategy: viper.GetString("IDSTRATEGY"),
+		IDLength:   viper.GetInt("IDLENGTH"),
+		IDAlphabet: viper.GetString("IDALPHABET"),
+		IDSecret:   viper.GetString("IDSECRET"),
+		IDNode:     viper.GetInt("IDNODE"),
+		IDRetries:  viper.GetInt("IDRETRIES"),
+
+		RateLimitWindow:    viper.GetDuration("RATELIMITWINDOW"),
+		RateLimitShorten:   viper.GetInt("RATELIMITSHORTEN"),
+		RateLimitRedirect:  viper.GetInt("RATELIMITREDIRECT"),
+		RateLimitAPIKey:    viper.GetInt("RATELIMITAPIKEY"),
+		RateLimitAllowlist: splitList(viper.GetString("RATELIMITALLOWLIST")),
+
+		TrustedProxies: splitList(viper.GetString("TRUSTEDPROXIES")),
+
+		PasswordFailuresIP:    viper.GetInt("PASSWORDFAILURESIP"),
+		PasswordFailuresLink:  viper.GetInt("PASSWORDFAILURESLINK"),
+		PasswordFailureWindow: viper.GetDuration("PASSWORDFAILUREWINDOW"),
+
+		AllowedSchemes: splitList(viper.GetString("ALLOWEDSCHEMES")),
+		SelfHosts:      splitList(viper.GetString("SELFHOSTS")),
+		BlocklistFile:  viper.GetString("BLOCKLISTFILE"),
+
+		DefaultRedirectCode: viper.GetInt("DEFAULTREDIRECTCODE"),
+		RedirectMaxAge:      viper.GetDuration("REDIRECTMAXAGE"),
+		NotActiveResponse:   viper.GetString("NOTACTIVERESPONSE"),
+
+		DefaultTTL: viper.GetDuration("DEFAULTTTL"),
+		MaxTTL:     viper.GetDuration("MAXTTL"),
+		CacheTTL:   viper.GetDuration("CACHETTL"),
+
+		TombstoneRetention: viper.GetDuration("TOMBSTONERETENTION"),
+
+		CacheBreakerFailures: viper.GetInt("CACHEBREAKERFAILURES"),
+		CacheBreakerCooldown: viper.GetDuration("CACHEBREAKERCOOLDOWN"),
+
+		NegativeCacheTTL:     viper.GetDuration("NEGATIVECACHETTL"),
+		BloomBits:            viper.GetUint64("BLOOMBITS"),
+		BloomHashes:          viper.GetInt("BLOOMHASHES"),
+		BloomRebuildInterval: viper.GetDuration("BLOOMREBUILDINTERVAL"),
+
+		ServiceName:        viper.GetString("SERVICENAME"),
+		TracingExporter:    viper.GetString("TRACINGEXPORTER"),
+		TracingSampleRatio: viper.GetFloat64("TRACINGSAMPLERATIO"),
+		OTLPEndpoint:       viper.GetString("OTLPENDPOINT"),
+		OTLPInsecure:       viper.GetBool("OTLPINSECURE"),
+
+		MetricsPort:         viper.GetString("METRICSPORT"),
+		ActiveLinksInterval: viper.GetDuration("ACTIVELINKSINTERVAL"),
+
+		OpTimeout:       viper.GetDuration("OPTIMEOUT"),
+		HealthTimeout:   viper.GetDuration("HEALTHTIMEOUT"),
+		ShutdownDelay:   viper.GetDuration("SHUTDOWNDELAY"),
+		ShutdownTimeout: viper.GetDuration("SHUTDOWNTIMEOUT"),
+	}
+}
+
+// splitList parses a comma-separated environment value.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
 	}
+	return out
 }
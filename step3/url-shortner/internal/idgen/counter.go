@@ -0,0 +1,108 @@
+package idgen
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+const feistelRounds = 4
+
+// Incrementer is the shared counter behind a Counter, typically Redis INCR.
+type Incrementer interface {
+	Incr(ctx context.Context, key string) (int64, error)
+}
+
+// Counter takes the next value of a shared counter and maps it through a
+// keyed permutation of [0, alphabet^length), so IDs are unique without
+// retries yet do not reveal how many links exist or which one comes next.
+// IDs can still collide with aliases or with IDs from the fallback used
+// while the counter is unreachable; the store rejects those.
+type Counter struct {
+	incr     Incrementer
+	key      string
+	alphabet Alphabet
+	length   int
+	space    uint64
+	perm     feistel
+	fallback Generator
+}
+
+// NewCounter permutes with secret. Changing the secret, alphabet or length
+// of a live counter reshuffles the mapping, so new IDs may collide with old
+// ones and are retried by the store.
+func NewCounter(incr Incrementer, key string, alphabet Alphabet, length int, secret string) (*Counter, error) {
+	space, err := alphabet.space(length)
+	if err != nil {
+		return nil, err
+	}
+	return &Counter{
+		incr:     incr,
+		key:      key,
+		alphabet: alphabet,
+		length:   length,
+		space:    space,
+		perm:     newFeistel(space, secret),
+	}, nil
+}
+
+func (c *Counter) Next(ctx context.Context) (string, error) {
+	n, err := c.incr.Incr(ctx, c.key)
+	if err != nil {
+		if c.fallback != nil {
+			return c.fallback.Next(ctx)
+		}
+		return "", err
+	}
+	if n < 0 || uint64(n) >= c.space {
+		return "", fmt.Errorf("%w: counter %s reached %d", ErrExhausted, c.key, n)
+	}
+	return c.alphabet.encode(c.perm.permute(uint64(n)), c.length), nil
+}
+
+// feistel is a balanced Feistel network over the smallest even number of
+// bits covering [0, space). Values that land outside the space are
+// encrypted again (cycle walking), which keeps it a permutation of
+// [0, space).
+type feistel struct {
+	space uint64
+	half  uint
+	mask  uint64
+	key   []byte
+}
+
+func newFeistel(space uint64, secret string) feistel {
+	n := uint(bits.Len64(space - 1))
+	n += n % 2
+	half := max(n/2, 1)
+	return feistel{space: space, half: half, mask: 1<<half - 1, key: []byte(secret)}
+}
+
+func (f feistel) permute(x uint64) uint64 {
+	for {
+		x = f.encrypt(x)
+		if x < f.space {
+			return x
+		}
+	}
+}
+
+func (f feistel) encrypt(x uint64) uint64 {
+	l, r := x>>f.half, x&f.mask
+	for i := 0; i < feistelRounds; i++ {
+		l, r = r, l^f.round(i, r)
+	}
+	return l<<f.half | r
+}
+
+func (f feistel) round(i int, r uint64) uint64 {
+	var msg [9]byte
+	msg[0] = byte(i)
+	binary.BigEndian.PutUint64(msg[1:], r)
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write(msg[:])
+	return binary.BigEndian.Uint64(mac.Sum(nil)) & f.mask
+}
@@ -0,0 +1,162 @@
+// Package idgen generates short link IDs. Every Generator draws from an
+// Alphabet; uniqueness is enforced by the store, which rejects duplicates,
+// so generators only need to make collisions rare.
+package idgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"strings"
+)
+
+// urlSafe are the characters short IDs may contain.
+const urlSafe = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz-_"
+
+// DefaultLength keeps collisions between random IDs rare for a few hundred
+// thousand links.
+const DefaultLength = 7
+
+// counterKey is the Redis key of the shared Counter.
+const counterKey = "idgen:counter"
+
+// MinSecretLength is the shortest secret New accepts for the counter. With
+// a known or guessable key the permutation can be inverted and every ID
+// enumerated.
+const MinSecretLength = 16
+
+// Base62 is the default alphabet: IDs are case-sensitive and contain no
+// punctuation.
+var Base62 = Alphabet{chars: "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"}
+
+// ErrExhausted is returned by a Counter once every ID of the configured
+// length has been handed out.
+var ErrExhausted = errors.New("ID space exhausted")
+
+type Generator interface {
+	Next(ctx context.Context) (string, error)
+}
+
+// Options select and configure a Generator. Zero values pick the defaults:
+// random base62 IDs of DefaultLength characters.
+type Options struct {
+	// Strategy is random, counter or snowflake.
+	Strategy string
+	Length   int
+	Alphabet string
+	// Secret keys the counter's permutation and must be at least
+	// MinSecretLength bytes.
+	Secret string
+	// Node is the snowflake node number; negative derives it from the
+	// hostname, which is the pod name on Kubernetes.
+	Node int
+}
+
+// New builds the Generator described by opts. The counter strategy needs
+// incr and falls back to random IDs while it cannot be reached.
+func New(opts Options, incr Incrementer) (Generator, error) {
+	alphabet := Base62
+	if opts.Alphabet != "" {
+		var err error
+		if alphabet, err = NewAlphabet(opts.Alphabet); err != nil {
+			return nil, err
+		}
+	}
+	length := opts.Length
+	if length == 0 {
+		length = DefaultLength
+	}
+	if length < 1 || length > 64 {
+		return nil, errors.New("ID length must be between 1 and 64")
+	}
+
+	switch strings.ToLower(opts.Strategy) {
+	case "", "random":
+		return NewRandom(alphabet, length), nil
+	case "counter":
+		if incr == nil {
+			return nil, errors.New("counter IDs need Redis")
+		}
+		if len(opts.Secret) < MinSecretLength {
+			return nil, fmt.Errorf("counter IDs need a secret of at least %d bytes", MinSecretLength)
+		}
+		c, err := NewCounter(incr, counterKey, alphabet, length, opts.Secret)
+		if err != nil {
+			return nil, err
+		}
+		c.fallback = NewRandom(alphabet, length)
+		return c, nil
+	case "snowflake":
+		node := opts.Node
+		if node < 0 {
+			node = hostnameNode()
+		}
+		return NewSnowflake(alphabet, length, node)
+	default:
+		return nil, fmt.Errorf("unknown ID strategy %q", opts.Strategy)
+	}
+}
+
+// hostnameNode hashes the hostname into a node number. Two replicas may
+// still share one; their rare duplicate IDs are then retried by the store.
+func hostnameNode() int {
+	name, _ := os.Hostname()
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % (MaxNode + 1))
+}
+
+// Alphabet is a validated set of distinct, URL-safe characters.
+type Alphabet struct {
+	chars string
+}
+
+func NewAlphabet(chars string) (Alphabet, error) {
+	if len(chars) < 2 {
+		return Alphabet{}, errors.New("alphabet needs at least 2 characters")
+	}
+	for i := 0; i < len(chars); i++ {
+		if !strings.ContainsRune(urlSafe, rune(chars[i])) {
+			return Alphabet{}, fmt.Errorf("alphabet character %q is not one of letters, digits, '-' or '_'", chars[i])
+		}
+		if strings.IndexByte(chars[i+1:], chars[i]) >= 0 {
+			return Alphabet{}, fmt.Errorf("alphabet character %q is repeated", chars[i])
+		}
+	}
+	return Alphabet{chars: chars}, nil
+}
+
+func (a Alphabet) base() uint64 {
+	return uint64(len(a.chars))
+}
+
+// encode writes n in base len(a), left-padded to at least length digits.
+func (a Alphabet) encode(n uint64, length int) string {
+	var buf [64]byte
+	i := len(buf)
+	for n > 0 || len(buf)-i < length {
+		i--
+		buf[i] = a.chars[n%a.base()]
+		n /= a.base()
+	}
+	return string(buf[i:])
+}
+
+// space returns the number of distinct IDs of length characters, or an
+// error when it does not fit in 63 bits.
+func (a Alphabet) space(length int) (uint64, error) {
+	if length < 1 {
+		return 0, errors.New("ID length must be at least 1")
+	}
+	n := uint64(1)
+	for i := 0; i < length; i++ {
+		if n > math.MaxInt64/a.base() {
+			return 0, fmt.Errorf("%d characters of a %d-character alphabet exceed 63 bits", length, a.base())
+		}
+		n *= a.base()
+	}
+	return n, nil
+}
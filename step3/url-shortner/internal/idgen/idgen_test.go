@@ -0,0 +1,136 @@
+package idgen
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type counter struct {
+	mu  sync.Mutex
+	n   int64
+	err error
+}
+
+func (c *counter) Incr(context.Context, string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.n++
+	return c.n, nil
+}
+
+func TestNewAlphabet(t *testing.T) {
+	for _, chars := range []string{"a", "abca", "ab/c", "äb"} {
+		if _, err := NewAlphabet(chars); err == nil {
+			t.Errorf("%q: accepted", chars)
+		}
+	}
+	if _, err := NewAlphabet("0123456789abcdef-_"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	abc, _ := NewAlphabet("abc")
+	g := NewRandom(abc, 12)
+	id, err := g.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != 12 || strings.Trim(id, "abc") != "" {
+		t.Errorf("got %q", id)
+	}
+}
+
+func TestCounterIsAPermutation(t *testing.T) {
+	digits, _ := NewAlphabet("0123456789")
+	g, err := NewCounter(&counter{}, "k", digits, 3, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	sequential := 0
+	prev := -1
+	for i := 1; i < 1000; i++ {
+		id, err := g.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != 3 || seen[id] {
+			t.Fatalf("counter %d: got %q", i, id)
+		}
+		seen[id] = true
+
+		var n int
+		for _, d := range id {
+			n = n*10 + int(d-'0')
+		}
+		if n == prev+1 {
+			sequential++
+		}
+		prev = n
+	}
+	if sequential > 10 {
+		t.Errorf("%d of 999 IDs followed their predecessor", sequential)
+	}
+
+	if _, err := g.Next(context.Background()); !errors.Is(err, ErrExhausted) {
+		t.Errorf("past the space: got %v", err)
+	}
+}
+
+const testSecret = "0123456789abcdef"
+
+func TestCounterFallsBack(t *testing.T) {
+	g, err := New(Options{Strategy: "counter", Secret: testSecret}, &counter{err: errors.New("down")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := g.Next(context.Background())
+	if err != nil || len(id) != DefaultLength {
+		t.Errorf("got %q, %v", id, err)
+	}
+}
+
+func TestCounterLengthLimit(t *testing.T) {
+	if _, err := New(Options{Strategy: "counter", Length: 11, Secret: testSecret}, &counter{}); err == nil {
+		t.Error("11 base62 characters do not fit in 63 bits")
+	}
+}
+
+func TestCounterNeedsSecret(t *testing.T) {
+	for _, secret := range []string{"", "too-short"} {
+		if _, err := New(Options{Strategy: "counter", Secret: secret}, &counter{}); err == nil {
+			t.Errorf("secret %q was accepted", secret)
+		}
+	}
+}
+
+func TestSnowflakeIsMonotonic(t *testing.T) {
+	g, err := NewSnowflake(Base62, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	var prev uint64
+	// More IDs than the sequence allows per millisecond, with the clock
+	// stepping back half way.
+	for i := 0; i < 10000; i++ {
+		at := now
+		if i > 5000 {
+			at = now.Add(-time.Second)
+		}
+		n := g.next(at)
+		if n <= prev {
+			t.Fatalf("ID %d: %d after %d", i, n, prev)
+		}
+		prev = n
+	}
+}
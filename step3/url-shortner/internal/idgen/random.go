@@ -0,0 +1,40 @@
+package idgen
+
+import (
+	"context"
+	"crypto/rand"
+)
+
+// Random draws each character uniformly from the alphabet using
+// crypto/rand. Collisions become likely only once the number of links
+// nears the square root of the ID space: about 1.9 million for 7 base62
+// characters. The store rejects the duplicates that do occur.
+type Random struct {
+	alphabet Alphabet
+	length   int
+}
+
+func NewRandom(alphabet Alphabet, length int) *Random {
+	return &Random{alphabet: alphabet, length: length}
+}
+
+func (r *Random) Next(context.Context) (string, error) {
+	// Bytes at or above limit are rejected so every character is equally
+	// likely.
+	base := int(r.alphabet.base())
+	limit := 256 - 256%base
+
+	id := make([]byte, 0, r.length)
+	buf := make([]byte, r.length+r.length/2)
+	for len(id) < r.length {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(id) < r.length {
+				id = append(id, r.alphabet.chars[int(b)%base])
+			}
+		}
+	}
+	return string(id), nil
+}
@@ -0,0 +1,63 @@
+package idgen
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+	// MaxNode is the highest Snowflake node number.
+	MaxNode = 1<<snowflakeNodeBits - 1
+)
+
+// snowflakeEpoch keeps the timestamp small; 41 bits of milliseconds from it
+// last until 2093.
+var snowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Snowflake packs milliseconds since 2024, a node number and a per
+// millisecond sequence into 63 bits. IDs need no coordination as long as
+// every replica has its own node number, and sort by creation time. They
+// are about 11 base62 characters; shorter lengths only set a minimum.
+type Snowflake struct {
+	alphabet Alphabet
+	length   int
+	node     uint64
+
+	mu   sync.Mutex
+	last int64
+	seq  uint64
+}
+
+func NewSnowflake(alphabet Alphabet, length, node int) (*Snowflake, error) {
+	if node < 0 || node > MaxNode {
+		return nil, fmt.Errorf("snowflake node must be between 0 and %d", MaxNode)
+	}
+	return &Snowflake{alphabet: alphabet, length: length, node: uint64(node)}, nil
+}
+
+func (s *Snowflake) Next(context.Context) (string, error) {
+	return s.alphabet.encode(s.next(time.Now()), s.length), nil
+}
+
+// next never goes backwards: if the clock does, or the sequence runs out
+// within a millisecond, it borrows the following millisecond instead of
+// waiting.
+func (s *Snowflake) next(now time.Time) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ms := now.Sub(snowflakeEpoch).Milliseconds()
+	if ms > s.last {
+		s.last, s.seq = ms, 0
+	} else {
+		s.seq++
+		if s.seq == 1<<snowflakeSeqBits {
+			s.last, s.seq = s.last+1, 0
+		}
+	}
+	return uint64(s.last)<<(snowflakeNodeBits+snowflakeSeqBits) | s.node<<snowflakeSeqBits | s.seq
+}
@@ -0,0 +1,225 @@
+// Package metrics holds the Prometheus collectors exported on METRICSPORT.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const namespace = "urlshortener"
+
+// Redirect outcomes.
+const (
+	RedirectHit      = "hit"
+	RedirectMiss     = "miss"
+	RedirectNotFound = "not_found"
+	RedirectExpired  = "expired"
+	RedirectDeleted  = "deleted"
+	// RedirectExhausted links have used up their MaxClicks.
+	RedirectExhausted = "exhausted"
+	// RedirectNotActive links were followed before their ActivateAt.
+	RedirectNotActive = "not_active"
+	// RedirectError requests failed because the link could not be looked
+	// up or its click could not be counted.
+	RedirectError = "error"
+)
+
+// Cache lookup results.
+const (
+	CacheHit   = "hit"
+	CacheMiss  = "miss"
+	CacheError = "error"
+	// CacheSkipped lookups were not attempted because the breaker is open.
+	CacheSkipped = "skipped"
+)
+
+// Password attempt results.
+const (
+	PasswordSuccess   = "success"
+	PasswordFailure   = "failure"
+	PasswordThrottled = "throttled"
+)
+
+// Reasons a cache miss was answered without querying MongoDB.
+const (
+	AvoidedInvalidID     = "invalid_id"
+	AvoidedFilter        = "filter"
+	AvoidedNegativeCache = "negative_cache"
+	AvoidedCoalesced     = "coalesced"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and method.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"route", "method"})
+
+	redirects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redirects_total",
+		Help:      "Short link resolutions by outcome: hit, miss, not_found, expired, deleted, exhausted or not_active.",
+	}, []string{"outcome"})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Redis link cache lookups by result: hit, miss, error or skipped.",
+	}, []string{"result"})
+
+	cacheWritesSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_writes_skipped_total",
+		Help:      "Cache keys not written or invalidated, by operation and reason: breaker_open or error.",
+	}, []string{"op", "reason"})
+
+	cacheBreakerOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_breaker_open",
+		Help:      "1 while the Redis circuit breaker is open.",
+	})
+
+	mongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mongo_command_duration_seconds",
+		Help:      "MongoDB command latency by command name and outcome.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command", "outcome"})
+
+	lookupsAvoided = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_lookups_avoided_total",
+		Help:      "Cache misses answered without a MongoDB query, by reason.",
+	}, []string{"reason"})
+
+	idCollisions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "id_collisions_total",
+		Help:      "Generated short IDs that were already taken.",
+	})
+
+	passwordAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "password_attempts_total",
+		Help:      "Password submissions for protected links by result: success, failure or throttled.",
+	}, []string{"result"})
+
+	activeLinks = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_links",
+		Help:      "Links that exist and have not expired, refreshed periodically.",
+	})
+)
+
+// Middleware records request count and latency. Routes are labelled with
+// their pattern, such as /:hsh, so short IDs never become label values.
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		code := c.Response().Status
+		var he *echo.HTTPError
+		if errors.As(err, &he) {
+			code = he.Code
+		}
+		route := c.Path()
+		if route == "" || code == http.StatusNotFound && route == "/*" {
+			route = "unmatched"
+		}
+		method := c.Request().Method
+
+		httpRequests.WithLabelValues(route, method, strconv.Itoa(code)).Inc()
+		httpDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func Redirect(outcome string) {
+	redirects.WithLabelValues(outcome).Inc()
+}
+
+func CacheLookup(result string) {
+	cacheLookups.WithLabelValues(result).Inc()
+}
+
+func CacheWriteSkipped(op, reason string, keys int) {
+	cacheWritesSkipped.WithLabelValues(op, reason).Add(float64(keys))
+}
+
+func CacheBreakerOpen(open bool) {
+	if open {
+		cacheBreakerOpen.Set(1)
+	} else {
+		cacheBreakerOpen.Set(0)
+	}
+}
+
+func LookupAvoided(reason string) {
+	lookupsAvoided.WithLabelValues(reason).Inc()
+}
+
+func PasswordAttempt(result string) {
+	passwordAttempts.WithLabelValues(result).Inc()
+}
+
+func IDCollision() {
+	idCollisions.Inc()
+}
+
+// CommandMonitor times every command sent by the MongoDB client.
+func CommandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			mongoDuration.WithLabelValues(e.CommandName, "success").Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			mongoDuration.WithLabelValues(e.CommandName, "failure").Observe(e.Duration.Seconds())
+		},
+	}
+}
+
+// RunActiveLinks refreshes the active_links gauge every interval until ctx
+// is cancelled. Counting on each scrape would put the load on MongoDB in
+// the hands of the scraper.
+func RunActiveLinks(ctx context.Context, interval time.Duration, count func(context.Context) (int64, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := count(ctx)
+		if err == nil {
+			activeLinks.Set(float64(n))
+		} else if ctx.Err() == nil {
+			log.Printf("counting active links failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Handler serves the default registry, which also carries the Go runtime
+// and process collectors.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
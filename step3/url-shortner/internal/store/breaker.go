@@ -0,0 +1,360 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+	"url-shortner/internal/metrics"
+)
+
+const (
+	probeTimeout = 5 * time.Second
+	// maxPendingInvalidations bounds the keys remembered while the breaker
+	// is open. Beyond it, entries may stay stale until they expire.
+	maxPendingInvalidations = 10000
+	replayBatchSize         = 500
+)
+
+// Breaker is a circuit breaker shared by everything that talks to one Redis.
+// After threshold consecutive failures it opens and calls fail fast with
+// ErrCacheUnavailable. Once cooldown has passed, the next call starts a
+// background probe; the breaker closes when every probe hook succeeds.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	open     bool
+	failures int
+	openedAt time.Time
+	probing  bool
+	probes   []func(context.Context) error
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Open reports whether calls are currently short-circuited.
+func (b *Breaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// onProbe registers a hook that must succeed before the breaker closes.
+func (b *Breaker) onProbe(fn func(context.Context) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probes = append(b.probes, fn)
+}
+
+// do runs fn unless the breaker is open and records its outcome.
+func (b *Breaker) do(fn func() error) error {
+	if !b.allow() {
+		return ErrCacheUnavailable
+	}
+	err := fn()
+	b.record(err)
+	return err
+}
+
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true
+	}
+	if !b.probing && time.Since(b.openedAt) >= b.cooldown {
+		b.probing = true
+		go b.probe()
+	}
+	return false
+}
+
+// record counts failures. Misses and reached limits are normal answers, and
+// cancellations say nothing about Redis, so none of them count.
+func (b *Breaker) record(err error) {
+	failed := err != nil && !answered(err) && !errors.Is(err, context.Canceled)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if !b.open && b.failures >= b.threshold {
+		b.open, b.openedAt = true, time.Now()
+		metrics.CacheBreakerOpen(true)
+		log.Printf("cache circuit breaker opened after %d consecutive failures: %v", b.failures, err)
+	}
+}
+
+// answered reports whether err is a reply from Redis rather than a failure
+// to reach it.
+func answered(err error) bool {
+	return errors.Is(err, ErrCacheMiss) || errors.Is(err, ErrLimitReached)
+}
+
+func (b *Breaker) probe() {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	b.mu.Lock()
+	probes := b.probes
+	b.mu.Unlock()
+
+	var err error
+	for _, fn := range probes {
+		if err = fn(ctx); err != nil {
+			break
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err != nil {
+		b.openedAt = time.Now()
+		return
+	}
+	b.open, b.failures = false, 0
+	metrics.CacheBreakerOpen(false)
+	log.Print("cache circuit breaker closed")
+}
+
+// BreakerCache guards a Cache with a Breaker. Writes that are skipped or
+// fail are counted, and their keys are deleted before the breaker closes
+// again, so entries that missed an update while Redis was unreachable are
+// not served afterwards.
+type BreakerCache struct {
+	cache   Cache
+	breaker *Breaker
+
+	mu         sync.Mutex
+	pending    map[string]struct{}
+	overflowed bool
+}
+
+func NewBreakerCache(cache Cache, breaker *Breaker) *BreakerCache {
+	c := &BreakerCache{cache: cache, breaker: breaker, pending: make(map[string]struct{})}
+	breaker.onProbe(c.recover)
+	return c
+}
+
+func (c *BreakerCache) Get(ctx context.Context, key string) ([]byte, error) {
+	var b []byte
+	err := c.breaker.do(func() (err error) {
+		b, err = c.cache.Get(ctx, key)
+		return err
+	})
+	return b, err
+}
+
+func (c *BreakerCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	err := c.breaker.do(func() error {
+		return c.cache.Set(ctx, key, value, ttl)
+	})
+	c.dropped("set", err, key)
+	return err
+}
+
+func (c *BreakerCache) SetMany(ctx context.Context, entries []CacheEntry) error {
+	err := c.breaker.do(func() error {
+		return c.cache.SetMany(ctx, entries)
+	})
+	if err != nil {
+		keys := make([]string, len(entries))
+		for i, e := range entries {
+			keys[i] = e.Key
+		}
+		c.dropped("set", err, keys...)
+	}
+	return err
+}
+
+func (c *BreakerCache) Del(ctx context.Context, keys ...string) error {
+	err := c.breaker.do(func() error {
+		return c.cache.Del(ctx, keys...)
+	})
+	c.dropped("del", err, keys...)
+	return err
+}
+
+func (c *BreakerCache) Incr(ctx context.Context, key string) (int64, error) {
+	var n int64
+	err := c.breaker.do(func() (err error) {
+		n, err = c.cache.Incr(ctx, key)
+		return err
+	})
+	return n, err
+}
+
+func (c *BreakerCache) IncrBounded(ctx context.Context, key string, max int64, seed *int64, ttl time.Duration) (int64, error) {
+	var n int64
+	err := c.breaker.do(func() (err error) {
+		n, err = c.cache.IncrBounded(ctx, key, max, seed, ttl)
+		return err
+	})
+	return n, err
+}
+
+func (c *BreakerCache) SlidingWindow(ctx context.Context, key string, limit int, window time.Duration) (WindowResult, error) {
+	var res WindowResult
+	err := c.breaker.do(func() (err error) {
+		res, err = c.cache.SlidingWindow(ctx, key, limit, window)
+		return err
+	})
+	return res, err
+}
+
+func (c *BreakerCache) Uncount(ctx context.Context, key, token string) error {
+	return c.breaker.do(func() error {
+		return c.cache.Uncount(ctx, key, token)
+	})
+}
+
+// Ping bypasses the breaker so health checks always see the real state.
+func (c *BreakerCache) Ping(ctx context.Context) error {
+	return c.cache.Ping(ctx)
+}
+
+// dropped remembers keys whose cached value may now be stale.
+func (c *BreakerCache) dropped(op string, err error, keys ...string) {
+	if err == nil {
+		return
+	}
+	reason := "error"
+	if err == ErrCacheUnavailable {
+		reason = "breaker_open"
+	}
+	metrics.CacheWriteSkipped(op, reason, len(keys))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if len(c.pending) >= maxPendingInvalidations {
+			c.overflowed = true
+			return
+		}
+		c.pending[key] = struct{}{}
+	}
+}
+
+// recover is the breaker probe: Redis must answer, and every pending key
+// must be deleted, before cached entries are trusted again. Writes skipped
+// while it runs add more keys, so it drains until nothing is left.
+func (c *BreakerCache) recover(ctx context.Context) error {
+	if err := c.cache.Ping(ctx); err != nil {
+		return err
+	}
+
+	for {
+		c.mu.Lock()
+		batch := make([]string, 0, replayBatchSize)
+		for key := range c.pending {
+			if len(batch) == replayBatchSize {
+				break
+			}
+			batch = append(batch, key)
+		}
+		c.mu.Unlock()
+		if len(batch) == 0 {
+			break
+		}
+
+		if err := c.cache.Del(ctx, batch...); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		for _, key := range batch {
+			delete(c.pending, key)
+		}
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	overflowed := c.overflowed
+	c.overflowed = false
+	c.mu.Unlock()
+	if overflowed {
+		log.Printf("more than %d cache writes were lost while Redis was unavailable; some entries may be stale until they expire", maxPendingInvalidations)
+	}
+	return nil
+}
+
+// BreakerFilter guards a Filter with the Breaker of the Redis it lives in.
+// A filter that missed an Add cannot be trusted, so it reports itself as not
+// built until it has been invalidated.
+type BreakerFilter struct {
+	filter  Filter
+	breaker *Breaker
+	dirty   atomic.Bool
+}
+
+func NewBreakerFilter(filter Filter, breaker *Breaker) *BreakerFilter {
+	f := &BreakerFilter{filter: filter, breaker: breaker}
+	breaker.onProbe(f.recover)
+	return f
+}
+
+func (f *BreakerFilter) Add(ctx context.Context, ids ...string) error {
+	err := f.breaker.do(func() error {
+		return f.filter.Add(ctx, ids...)
+	})
+	if err != nil {
+		f.dirty.Store(true)
+	}
+	return err
+}
+
+func (f *BreakerFilter) Test(ctx context.Context, id string) (bool, error) {
+	if f.dirty.Load() {
+		return false, ErrCacheUnavailable
+	}
+	var ok bool
+	err := f.breaker.do(func() (err error) {
+		ok, err = f.filter.Test(ctx, id)
+		return err
+	})
+	return ok, err
+}
+
+func (f *BreakerFilter) Invalidate(ctx context.Context) error {
+	err := f.breaker.do(func() error {
+		return f.filter.Invalidate(ctx)
+	})
+	if err == nil {
+		f.dirty.Store(false)
+	}
+	return err
+}
+
+// Refresh is skipped while the breaker is open. Its errors are not recorded,
+// since they may come from the LinkStore rather than Redis.
+func (f *BreakerFilter) Refresh(ctx context.Context, maxAge time.Duration, each func(context.Context, func(string) error) error) error {
+	if f.breaker.Open() {
+		return ErrCacheUnavailable
+	}
+	if f.dirty.Load() {
+		if err := f.Invalidate(ctx); err != nil {
+			return err
+		}
+	}
+	return f.filter.Refresh(ctx, maxAge, each)
+}
+
+func (f *BreakerFilter) recover(ctx context.Context) error {
+	if !f.dirty.Load() {
+		return nil
+	}
+	if err := f.filter.Invalidate(ctx); err != nil {
+		return err
+	}
+	f.dirty.Store(false)
+	return nil
+}
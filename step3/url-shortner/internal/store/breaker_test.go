@@ -0,0 +1,147 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyCache fails every call while down is set and counts the calls that
+// reach it.
+type flakyCache struct {
+	*MemoryCache
+	down  atomic.Bool
+	calls atomic.Int32
+}
+
+var errFlaky = errors.New("connection refused")
+
+func (f *flakyCache) fail() error {
+	f.calls.Add(1)
+	if f.down.Load() {
+		return errFlaky
+	}
+	return nil
+}
+
+func (f *flakyCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.MemoryCache.Get(ctx, key)
+}
+
+func (f *flakyCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.MemoryCache.Set(ctx, key, value, ttl)
+}
+
+func (f *flakyCache) Del(ctx context.Context, keys ...string) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.MemoryCache.Del(ctx, keys...)
+}
+
+func (f *flakyCache) Ping(ctx context.Context) error {
+	if f.down.Load() {
+		return errFlaky
+	}
+	return nil
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBreakerCache(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyCache{MemoryCache: NewMemoryCache()}
+	breaker := NewBreaker(3, 20*time.Millisecond)
+	cache := NewBreakerCache(flaky, breaker)
+
+	cache.Set(ctx, "short:a", []byte("old"), 0)
+	flaky.down.Store(true)
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.Get(ctx, "short:a"); err != errFlaky {
+			t.Fatalf("call %d: got %v", i, err)
+		}
+	}
+	if !breaker.Open() {
+		t.Fatal("breaker did not open")
+	}
+
+	// While open, calls fail fast without reaching Redis.
+	calls := flaky.calls.Load()
+	if err := cache.Del(ctx, "short:a"); err != ErrCacheUnavailable {
+		t.Fatalf("Del: got %v", err)
+	}
+	if _, err := cache.Get(ctx, "short:a"); err != ErrCacheUnavailable {
+		t.Fatalf("Get: got %v", err)
+	}
+	if flaky.calls.Load() != calls {
+		t.Error("calls reached Redis while the breaker was open")
+	}
+
+	// Recovery needs Redis back and the cooldown over; the skipped Del is
+	// replayed before the breaker closes.
+	time.Sleep(30 * time.Millisecond)
+	cache.Get(ctx, "short:a")
+	time.Sleep(30 * time.Millisecond)
+	if !breaker.Open() {
+		t.Fatal("breaker closed while Redis was down")
+	}
+
+	flaky.down.Store(false)
+	cache.Get(ctx, "short:a")
+	waitFor(t, func() bool { return !breaker.Open() })
+
+	if _, err := cache.Get(ctx, "short:a"); err != ErrCacheMiss {
+		t.Errorf("stale entry survived recovery: %v", err)
+	}
+}
+
+func TestBreakerIgnoresMissesAndCancellation(t *testing.T) {
+	breaker := NewBreaker(1, time.Minute)
+	breaker.do(func() error { return ErrCacheMiss })
+	breaker.do(func() error { return context.Canceled })
+	if breaker.Open() {
+		t.Fatal("breaker opened on a miss or a cancellation")
+	}
+}
+
+func TestBreakerFilter(t *testing.T) {
+	ctx := context.Background()
+	breaker := NewBreaker(1, 20*time.Millisecond)
+	inner := NewMemoryFilter()
+	filter := NewBreakerFilter(inner, breaker)
+
+	breaker.do(func() error { return errFlaky })
+	if err := filter.Add(ctx, "new-link"); err != ErrCacheUnavailable {
+		t.Fatalf("Add: got %v", err)
+	}
+
+	// The filter missed an ID, so it must not answer until invalidated.
+	time.Sleep(30 * time.Millisecond)
+	if _, err := filter.Test(ctx, "new-link"); err == nil {
+		t.Fatal("dirty filter answered")
+	}
+	// Any call through the breaker, such as a cache read, starts the probe.
+	breaker.do(func() error { return nil })
+	waitFor(t, func() bool { return !breaker.Open() })
+	if _, err := filter.Test(ctx, "new-link"); err != ErrCacheMiss {
+		t.Errorf("filter was not invalidated on recovery: %v", err)
+	}
+}
@@ -0,0 +1,515 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-process LinkStore for tests and local development.
+// Nothing is ever purged: tombstones stay until their ID is reused.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	links  map[string]URL
+	clicks []Click
+	keys   map[string]APIKey
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		links: make(map[string]URL),
+		keys:  make(map[string]APIKey),
+	}
+}
+
+func (m *MemoryStore) Insert(ctx context.Context, url URL) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.links[url.ID]; ok && !old.reclaimable() {
+		return ErrDuplicate
+	}
+	m.links[url.ID] = url
+	return nil
+}
+
+func (m *MemoryStore) InsertMany(ctx context.Context, urls []URL) []error {
+	errs := make([]error, len(urls))
+	for i, url := range urls {
+		errs[i] = m.Insert(ctx, url)
+	}
+	return errs
+}
+
+func (m *MemoryStore) Get(ctx context.Context, id string) (URL, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	url, ok := m.links[id]
+	if !ok {
+		return URL{}, ErrNotFound
+	}
+	if url.Deleted() {
+		return url, ErrDeleted
+	}
+	return url, nil
+}
+
+func (m *MemoryStore) Update(ctx context.Context, id string, version int, owner string, patch LinkPatch) (URL, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	url, ok := m.links[id]
+	if !ok || url.Version != version || url.Deleted() || (owner != "" && url.Owner != owner) {
+		return URL{}, ErrNotFound
+	}
+
+	if patch.Original != nil {
+		url.Original = *patch.Original
+		url.Domain = TargetDomain(*patch.Original)
+	}
+	if patch.SetExpireAt {
+		url.ExpireAt = patch.ExpireAt
+	}
+	if patch.RedirectCode != nil {
+		url.RedirectCode = *patch.RedirectCode
+	}
+	if patch.Interstitial != nil {
+		url.Interstitial = *patch.Interstitial
+	}
+	if patch.PasswordHash != nil {
+		url.PasswordHash = *patch.PasswordHash
+	}
+	if patch.MaxClicks != nil {
+		url.MaxClicks = *patch.MaxClicks
+	}
+	if patch.SetActivateAt {
+		url.ActivateAt = patch.ActivateAt
+	}
+	if patch.FallbackURL != nil {
+		url.FallbackURL = *patch.FallbackURL
+	}
+	if patch.Tags != nil {
+		url.Tags = *patch.Tags
+	}
+	url.Version++
+	m.links[id] = url
+	return url, nil
+}
+
+func (m *MemoryStore) Delete(ctx context.Context, id, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	url, ok := m.links[id]
+	if !ok || url.Deleted() || (owner != "" && url.Owner != owner) {
+		return ErrNotFound
+	}
+	now := time.Now()
+	url.DeletedAt = &now
+	m.links[id] = url
+	return nil
+}
+
+func (m *MemoryStore) ConsumeClick(ctx context.Context, id string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	url, ok := m.links[id]
+	if !ok || url.Deleted() || url.MaxClicks <= 0 || url.Used >= url.MaxClicks {
+		return 0, ErrLimitReached
+	}
+	url.Used++
+	m.links[id] = url
+	return url.Used, nil
+}
+
+func (m *MemoryStore) SyncUsage(ctx context.Context, id string, used int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if url, ok := m.links[id]; ok && used > url.Used {
+		url.Used = used
+		m.links[id] = url
+	}
+	return nil
+}
+
+func (m *MemoryStore) CountActive(ctx context.Context) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var n int64
+	for _, url := range m.links {
+		if !url.Expired() && !url.Deleted() {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MemoryStore) ListLinks(ctx context.Context, q LinkQuery) ([]URL, error) {
+	// before reports whether a is listed before b.
+	before := func(a, b LinkCursor) bool {
+		c := compareCursors(q.Sort, a, b)
+		if q.Ascending {
+			return c < 0
+		}
+		return c > 0
+	}
+
+	m.mu.RLock()
+	urls := []URL{}
+	for _, url := range m.links {
+		if matchesQuery(url, q) && (q.After == nil || before(*q.After, url.Cursor())) {
+			urls = append(urls, url)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(urls, func(i, j int) bool {
+		return before(urls[i].Cursor(), urls[j].Cursor())
+	})
+	if len(urls) > q.Limit {
+		urls = urls[:q.Limit]
+	}
+	return urls, nil
+}
+
+func matchesQuery(url URL, q LinkQuery) bool {
+	if url.Deleted() {
+		return false
+	}
+	if q.Owner != "" && url.Owner != q.Owner || q.Domain != "" && url.Domain != q.Domain {
+		return false
+	}
+	if q.Tag != "" && !slices.Contains(url.Tags, q.Tag) {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && url.CreatedAt.Before(q.CreatedAfter) ||
+		!q.CreatedBefore.IsZero() && !url.CreatedAt.Before(q.CreatedBefore) {
+		return false
+	}
+	switch q.Expiry {
+	case ExpiryPermanent:
+		return url.ExpireAt == nil
+	case ExpiryExpiring:
+		return url.ExpireAt != nil && !url.Expired()
+	case ExpiryExpired:
+		return url.Expired()
+	}
+	return true
+}
+
+// compareCursors orders a and b by the sort key, then by ID.
+func compareCursors(sortBy string, a, b LinkCursor) int {
+	var c int
+	if sortBy == SortClicks {
+		c = cmp.Compare(a.Clicks, b.Clicks)
+	} else {
+		c = a.CreatedAt.Compare(b.CreatedAt)
+	}
+	if c == 0 {
+		c = strings.Compare(a.ID, b.ID)
+	}
+	return c
+}
+
+func (m *MemoryStore) EachID(ctx context.Context, fn func(id string) error) error {
+	m.mu.RLock()
+	var ids []string
+	for id := range m.links {
+		ids = append(ids, id)
+	}
+	m.mu.RUnlock()
+
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) RecordClicks(ctx context.Context, clicks []Click) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clicks = append(m.clicks, clicks...)
+	for _, click := range clicks {
+		if url, ok := m.links[click.ShortID]; ok && !click.Timestamp.Before(url.CreatedAt) {
+			url.Clicks++
+			m.links[click.ShortID] = url
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) ClickStats(ctx context.Context, id string, created, hourlySince, dailySince time.Time) (ClickStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var stats ClickStats
+	visitors := make(map[string]struct{})
+	hourly, daily := make(map[string]int), make(map[string]int)
+	for _, click := range m.clicks {
+		if click.ShortID != id || click.Timestamp.Before(created) {
+			continue
+		}
+		stats.Total++
+		visitors[click.Visitor] = struct{}{}
+		ts := click.Timestamp.UTC()
+		if !ts.Before(hourlySince) {
+			hourly[ts.Format(HourFormat)]++
+		}
+		if !ts.Before(dailySince) {
+			daily[ts.Format(DayFormat)]++
+		}
+	}
+	stats.Unique = len(visitors)
+	stats.Hourly, stats.Daily = buckets(hourly), buckets(daily)
+	return stats, nil
+}
+
+func buckets(counts map[string]int) []ClickBucket {
+	var out []ClickBucket
+	for period, n := range counts {
+		out = append(out, ClickBucket{Period: period, Clicks: n})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Period < out[j].Period })
+	return out
+}
+
+func (m *MemoryStore) CreateAPIKey(ctx context.Context, key APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.keys[key.Hash]; ok {
+		return ErrDuplicate
+	}
+	m.keys[key.Hash] = key
+	return nil
+}
+
+func (m *MemoryStore) APIKey(ctx context.Context, hash string) (APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key, ok := m.keys[hash]
+	if !ok {
+		return APIKey{}, ErrNotFound
+	}
+	return key, nil
+}
+
+func (m *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+type memoryEntry struct {
+	value    []byte
+	expireAt time.Time
+}
+
+func (e memoryEntry) live(now time.Time) bool {
+	return e.expireAt.IsZero() || now.Before(e.expireAt)
+}
+
+// MemoryCache is an in-process Cache for tests and local development.
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	windows map[string][]windowHit
+	seq     int
+}
+
+type windowHit struct {
+	at    time.Time
+	token string
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		entries: make(map[string]memoryEntry),
+		windows: make(map[string][]windowHit),
+	}
+}
+
+func (m *MemoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok || !e.live(time.Now()) {
+		delete(m.entries, key)
+		return nil, ErrCacheMiss
+	}
+	return e.value, nil
+}
+
+func (m *MemoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(key, value, ttl)
+	return nil
+}
+
+func (m *MemoryCache) set(key string, value []byte, ttl time.Duration) {
+	e := memoryEntry{value: value}
+	if ttl > 0 {
+		e.expireAt = time.Now().Add(ttl)
+	}
+	m.entries[key] = e
+}
+
+func (m *MemoryCache) SetMany(ctx context.Context, entries []CacheEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range entries {
+		m.set(e.Key, e.Value, e.TTL)
+	}
+	return nil
+}
+
+func (m *MemoryCache) Del(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.entries, key)
+		delete(m.windows, key)
+	}
+	return nil
+}
+
+func (m *MemoryCache) Incr(ctx context.Context, key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	e, ok := m.entries[key]
+	if ok && e.live(time.Now()) {
+		var err error
+		if n, err = strconv.ParseInt(string(e.value), 10, 64); err != nil {
+			return 0, err
+		}
+	} else {
+		e = memoryEntry{}
+	}
+	n++
+	e.value = []byte(strconv.FormatInt(n, 10))
+	m.entries[key] = e
+	return n, nil
+}
+
+func (m *MemoryCache) IncrBounded(ctx context.Context, key string, max int64, seed *int64, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	if e, ok := m.entries[key]; ok && e.live(time.Now()) {
+		var err error
+		if n, err = strconv.ParseInt(string(e.value), 10, 64); err != nil {
+			return 0, err
+		}
+	} else if seed != nil {
+		n = *seed
+	} else {
+		return 0, ErrCacheMiss
+	}
+	if n >= max {
+		return 0, ErrLimitReached
+	}
+	n++
+	m.set(key, []byte(strconv.FormatInt(n, 10)), ttl)
+	return n, nil
+}
+
+func (m *MemoryCache) SlidingWindow(ctx context.Context, key string, limit int, window time.Duration) (WindowResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	hits := m.windows[key][:0]
+	for _, h := range m.windows[key] {
+		if now.Sub(h.at) < window {
+			hits = append(hits, h)
+		}
+	}
+
+	res := WindowResult{Reset: window}
+	if len(hits) < limit {
+		m.seq++
+		res.Token = strconv.Itoa(m.seq)
+		hits = append(hits, windowHit{at: now, token: res.Token})
+		res.Allowed = true
+	}
+	res.Count = len(hits)
+	if len(hits) > 0 {
+		res.Reset = hits[0].at.Add(window).Sub(now)
+	}
+	m.windows[key] = hits
+	return res, nil
+}
+
+func (m *MemoryCache) Uncount(ctx context.Context, key, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.windows[key] = slices.DeleteFunc(m.windows[key], func(h windowHit) bool { return h.token == token })
+	return nil
+}
+
+func (m *MemoryCache) Ping(ctx context.Context) error {
+	return nil
+}
+
+// MemoryFilter is an exact, in-process Filter for tests. It starts built
+// and empty.
+type MemoryFilter struct {
+	mu      sync.Mutex
+	ids     map[string]struct{}
+	builtAt time.Time
+}
+
+func NewMemoryFilter() *MemoryFilter {
+	return &MemoryFilter{ids: make(map[string]struct{}), builtAt: time.Now()}
+}
+
+func (m *MemoryFilter) Add(ctx context.Context, ids ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		m.ids[id] = struct{}{}
+	}
+	return nil
+}
+
+func (m *MemoryFilter) Test(ctx context.Context, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.builtAt.IsZero() {
+		return false, ErrCacheMiss
+	}
+	_, ok := m.ids[id]
+	return ok, nil
+}
+
+func (m *MemoryFilter) Invalidate(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.builtAt = time.Time{}
+	return nil
+}
+
+func (m *MemoryFilter) Refresh(ctx context.Context, maxAge time.Duration, each func(context.Context, func(string) error) error) error {
+	m.mu.Lock()
+	fresh := !m.builtAt.IsZero() && (maxAge <= 0 || time.Since(m.builtAt) < maxAge)
+	m.mu.Unlock()
+	if fresh {
+		return nil
+	}
+
+	ids := make(map[string]struct{})
+	err := each(ctx, func(id string) error {
+		ids[id] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.ids, m.builtAt = ids, time.Now()
+	m.mu.Unlock()
+	return nil
+}
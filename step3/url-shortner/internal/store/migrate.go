@@ -0,0 +1,276 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// linkIndexes back the TTL sweep and the link listings. Listing indexes end
+// in _id, the tiebreaker of every listing sort, so pages are read straight
+// off the index. Names are left to the server so an index created by hand
+// with the same keys and options is recognised instead of conflicting.
+func linkIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			// Documents are removed once purge_at has passed, which is the
+			// tombstone retention after they expire or are deleted.
+			Keys:    bson.D{{Key: "purge_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		// Live links, as CountActive and the listings' expiry filter select
+		// them. Leading with deleted_at also keeps the name clear of
+		// expire_at_1, the TTL index purgeAtExpiry drops after this is built.
+		{Keys: bson.D{{Key: "deleted_at", Value: 1}, {Key: "expire_at", Value: 1}}},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "clicks", Value: -1}, {Key: "_id", Value: -1}}},
+		{
+			// alias is omitted on generated links, so only aliases are
+			// indexed.
+			Keys:    bson.D{{Key: "alias", Value: 1}, {Key: "created_at", Value: -1}},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"alias": true}),
+		},
+		{Keys: bson.D{{Key: "tags", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "domain", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "clicks", Value: -1}, {Key: "_id", Value: -1}}},
+	}
+}
+
+// supersededIndexes are the server-assigned names of indexes replaced in
+// linkIndexes, dropped by a migration once their successors exist.
+var supersededIndexes = []string{
+	"owner_1_created_at_-1",
+	"tags_1_created_at_-1",
+}
+
+func clickIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{Keys: bson.D{{Key: "short_id", Value: 1}, {Key: "ts", Value: 1}}},
+	}
+}
+
+// EnsureIndexes creates the indexes the store relies on. Creating an index
+// that already exists with the same options is a no-op, so it is safe to
+// run on every startup. An existing index with the same keys but different
+// options is reported as an error rather than dropped.
+func (m *MongoStore) EnsureIndexes(ctx context.Context) error {
+	if err := createIndexes(ctx, m.links, linkIndexes()); err != nil {
+		return err
+	}
+	return createIndexes(ctx, m.clicks, clickIndexes())
+}
+
+func createIndexes(ctx context.Context, coll *mongo.Collection, models []mongo.IndexModel) error {
+	if _, err := coll.Indexes().CreateMany(ctx, models); err != nil {
+		return fmt.Errorf("%s: %w", coll.Name(), err)
+	}
+	return nil
+}
+
+// migration is a versioned change to stored documents. up must be
+// idempotent: replicas starting together may run it concurrently, and a
+// crash between up and recording it runs it again. Released migrations are
+// never edited or renumbered; fixes go into a new version.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, m *MongoStore) error
+}
+
+var migrations = []migration{
+	{1, "backfill link version", backfillVersion},
+	{2, "backfill link domain", backfillDomain},
+	{3, "backfill link click counts", backfillClicks},
+	{4, "drop superseded listing indexes", dropSupersededIndexes},
+	{5, "move the TTL index to purge_at", purgeAtExpiry},
+}
+
+const (
+	migrationBatchSize = 1000
+	// indexNotFound is the server error code for dropping a missing index.
+	indexNotFound = 27
+)
+
+type migrationRecord struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+// Migrate applies, in order, every migration not yet recorded in the
+// migrations collection. It stops at the first failure so that later
+// migrations can rely on earlier ones.
+func (m *MongoStore) Migrate(ctx context.Context) error {
+	cur, err := m.migrations.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var records []migrationRecord
+	if err := cur.All(ctx, &records); err != nil {
+		return err
+	}
+	applied := make(map[int]bool, len(records))
+	for _, r := range records {
+		applied[r.Version] = true
+		if r.Version > migrations[len(migrations)-1].version {
+			log.Printf("database has migration %d (%s), which this build does not know; was it rolled back?", r.Version, r.Name)
+		}
+	}
+
+	for _, mig := range migrations {
+		if applied[mig.version] {
+			continue
+		}
+		log.Printf("applying migration %d: %s", mig.version, mig.name)
+		if err := mig.up(ctx, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", mig.version, mig.name, err)
+		}
+		_, err := m.migrations.InsertOne(ctx, migrationRecord{
+			Version:   mig.version,
+			Name:      mig.name,
+			AppliedAt: time.Now().UTC(),
+		})
+		// Another replica recording it first is fine.
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillVersion sets version 0 on links created before optimistic
+// concurrency, so every document carries the field.
+func backfillVersion(ctx context.Context, m *MongoStore) error {
+	_, err := m.links.UpdateMany(ctx,
+		bson.M{"version": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"version": 0}},
+	)
+	return err
+}
+
+// backfillDomain derives domain from original_url on links created before
+// it was stored.
+func backfillDomain(ctx context.Context, m *MongoStore) error {
+	cur, err := m.links.Find(ctx, bson.M{"domain": bson.M{"$exists": false}},
+		options.Find().SetProjection(bson.M{"original_url": 1}).SetBatchSize(migrationBatchSize))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	var models []mongo.WriteModel
+	for cur.Next(ctx) {
+		var doc URL
+		if err := cur.Decode(&doc); err != nil {
+			return err
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": doc.ID}).
+			SetUpdate(bson.M{"$set": bson.M{"domain": TargetDomain(doc.Original)}}))
+		if len(models) == migrationBatchSize {
+			if err := bulkUpdate(ctx, m.links, models); err != nil {
+				return err
+			}
+			models = models[:0]
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	return bulkUpdate(ctx, m.links, models)
+}
+
+// backfillClicks sets clicks from the recorded click events, and to 0 on
+// links that have none, so every link can be sorted by it.
+func backfillClicks(ctx context.Context, m *MongoStore) error {
+	cur, err := m.clicks.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$short_id", "clicks": bson.M{"$sum": 1}}}},
+	}, options.Aggregate().SetAllowDiskUse(true).SetBatchSize(migrationBatchSize))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	var models []mongo.WriteModel
+	for cur.Next(ctx) {
+		var doc struct {
+			ID     string `bson:"_id"`
+			Clicks int64  `bson:"clicks"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return err
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": doc.ID}).
+			SetUpdate(bson.M{"$set": bson.M{"clicks": doc.Clicks}}))
+		if len(models) == migrationBatchSize {
+			if err := bulkUpdate(ctx, m.links, models); err != nil {
+				return err
+			}
+			models = models[:0]
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	if err := bulkUpdate(ctx, m.links, models); err != nil {
+		return err
+	}
+
+	_, err = m.links.UpdateMany(ctx,
+		bson.M{"clicks": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"clicks": 0}},
+	)
+	return err
+}
+
+func bulkUpdate(ctx context.Context, coll *mongo.Collection, models []mongo.WriteModel) error {
+	if len(models) == 0 {
+		return nil
+	}
+	_, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// dropSupersededIndexes removes indexes whose replacements EnsureIndexes has
+// already built. Indexes that are already gone are skipped.
+func dropSupersededIndexes(ctx context.Context, m *MongoStore) error {
+	for _, name := range supersededIndexes {
+		_, err := m.links.Indexes().DropOne(ctx, name)
+		var cmdErr mongo.CommandError
+		if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Code == indexNotFound) {
+			return fmt.Errorf("dropping %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// purgeAtExpiry keeps tombstones of links that expire from now on: it sets
+// purge_at on links with an expiry, then drops the TTL index on expire_at
+// that would remove them at once. EnsureIndexes has already created the one
+// on purge_at, and the one on deleted_at and expire_at that takes over its
+// queries.
+func purgeAtExpiry(ctx context.Context, m *MongoStore) error {
+	_, err := m.links.UpdateMany(ctx,
+		bson.M{"expire_at": bson.M{"$exists": true}, "purge_at": bson.M{"$exists": false}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"purge_at": bson.M{"$add": bson.A{"$expire_at", m.retention.Milliseconds()}},
+		}}}},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = m.links.Indexes().DropOne(ctx, "expire_at_1")
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Code == indexNotFound) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,458 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+type MongoStore struct {
+	links      *mongo.Collection
+	clicks     *mongo.Collection
+	keys       *mongo.Collection
+	migrations *mongo.Collection
+
+	// retention is how long tombstones of expired and deleted links are
+	// kept before the TTL index purges them.
+	retention time.Duration
+}
+
+func NewMongoStore(db *mongo.Database, links, clicks, keys, migrations string, retention time.Duration) *MongoStore {
+	return &MongoStore{
+		links:      db.Collection(links),
+		clicks:     db.Collection(clicks),
+		keys:       db.Collection(keys),
+		migrations: db.Collection(migrations),
+		retention:  retention,
+	}
+}
+
+// purgeAt is when a link expiring at expireAt is purged, nil for never.
+func (m *MongoStore) purgeAt(expireAt *time.Time) *time.Time {
+	if expireAt == nil {
+		return nil
+	}
+	t := expireAt.Add(m.retention)
+	return &t
+}
+
+func (m *MongoStore) Insert(ctx context.Context, url URL) error {
+	// The _id unique index makes the insert itself the reservation, so two
+	// concurrent requests for the same ID cannot both succeed.
+	url.PurgeAt = m.purgeAt(url.ExpireAt)
+	_, err := m.links.InsertOne(ctx, url)
+	if mongo.IsDuplicateKeyError(err) {
+		return m.reclaim(ctx, url)
+	}
+	return err
+}
+
+// reclaim replaces the tombstone holding url's ID, or returns ErrDuplicate
+// when a live link has it. The filter is evaluated atomically with the
+// write, so of two requests reclaiming the same ID only one succeeds.
+func (m *MongoStore) reclaim(ctx context.Context, url URL) error {
+	res, err := m.links.ReplaceOne(ctx, bson.M{"_id": url.ID, "$or": bson.A{
+		bson.M{"deleted_at": bson.M{"$exists": true}},
+		bson.M{"expire_at": bson.M{"$lte": time.Now()}},
+	}}, url)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrDuplicate
+	}
+	return nil
+}
+
+func (m *MongoStore) InsertMany(ctx context.Context, urls []URL) []error {
+	errs := make([]error, len(urls))
+	if len(urls) == 0 {
+		return errs
+	}
+
+	docs := make([]URL, len(urls))
+	models := make([]mongo.WriteModel, len(urls))
+	for i, url := range urls {
+		url.PurgeAt = m.purgeAt(url.ExpireAt)
+		docs[i] = url
+		models[i] = mongo.NewInsertOneModel().SetDocument(url)
+	}
+	_, err := m.links.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+
+	var bwe mongo.BulkWriteException
+	switch {
+	case err == nil:
+	case errors.As(err, &bwe) && bwe.WriteConcernError == nil:
+		for _, we := range bwe.WriteErrors {
+			if mongo.IsDuplicateKeyError(we) {
+				errs[we.Index] = m.reclaim(ctx, docs[we.Index])
+			} else {
+				errs[we.Index] = we
+			}
+		}
+	default:
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+func (m *MongoStore) Get(ctx context.Context, id string) (URL, error) {
+	var url URL
+	err := m.links.FindOne(ctx, bson.M{"_id": id}).Decode(&url)
+	if err == mongo.ErrNoDocuments {
+		return url, ErrNotFound
+	}
+	if err == nil && url.Deleted() {
+		return url, ErrDeleted
+	}
+	return url, err
+}
+
+func (m *MongoStore) Update(ctx context.Context, id string, version int, owner string, patch LinkPatch) (URL, error) {
+	set, unset := bson.M{}, bson.M{}
+	if patch.Original != nil {
+		set["original_url"] = *patch.Original
+		set["domain"] = TargetDomain(*patch.Original)
+	}
+	if patch.SetExpireAt {
+		if patch.ExpireAt != nil {
+			set["expire_at"] = *patch.ExpireAt
+			set["purge_at"] = *m.purgeAt(patch.ExpireAt)
+		} else {
+			unset["expire_at"] = ""
+			unset["purge_at"] = ""
+		}
+	}
+	if patch.RedirectCode != nil {
+		if *patch.RedirectCode == 0 {
+			unset["redirect_code"] = ""
+		} else {
+			set["redirect_code"] = *patch.RedirectCode
+		}
+	}
+	if patch.Interstitial != nil {
+		if *patch.Interstitial {
+			set["interstitial"] = true
+		} else {
+			unset["interstitial"] = ""
+		}
+	}
+	if patch.PasswordHash != nil {
+		if *patch.PasswordHash == "" {
+			unset["password_hash"] = ""
+		} else {
+			set["password_hash"] = *patch.PasswordHash
+		}
+	}
+	if patch.MaxClicks != nil {
+		if *patch.MaxClicks == 0 {
+			unset["max_clicks"] = ""
+		} else {
+			set["max_clicks"] = *patch.MaxClicks
+		}
+	}
+	if patch.SetActivateAt {
+		if patch.ActivateAt != nil {
+			set["activate_at"] = *patch.ActivateAt
+		} else {
+			unset["activate_at"] = ""
+		}
+	}
+	if patch.FallbackURL != nil {
+		if *patch.FallbackURL == "" {
+			unset["fallback_url"] = ""
+		} else {
+			set["fallback_url"] = *patch.FallbackURL
+		}
+	}
+	if patch.Tags != nil {
+		if len(*patch.Tags) == 0 {
+			unset["tags"] = ""
+		} else {
+			set["tags"] = *patch.Tags
+		}
+	}
+	update := bson.M{"$inc": bson.M{"version": 1}}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	var url URL
+	err := m.links.FindOneAndUpdate(ctx,
+		ownerFilter(bson.M{"_id": id, "version": versionMatch(version), "deleted_at": bson.M{"$exists": false}}, owner),
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&url)
+	if err == mongo.ErrNoDocuments {
+		return url, ErrNotFound
+	}
+	return url, err
+}
+
+func (m *MongoStore) Delete(ctx context.Context, id, owner string) error {
+	now := time.Now()
+	res, err := m.links.UpdateOne(ctx,
+		ownerFilter(bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}}, owner),
+		bson.M{"$set": bson.M{"deleted_at": now, "purge_at": now.Add(m.retention)}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MongoStore) ConsumeClick(ctx context.Context, id string) (int, error) {
+	var url URL
+	err := m.links.FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":        id,
+			"deleted_at": bson.M{"$exists": false},
+			"max_clicks": bson.M{"$gt": 0},
+			"$expr":      bson.M{"$lt": bson.A{bson.M{"$ifNull": bson.A{"$used", 0}}, "$max_clicks"}},
+		},
+		bson.M{"$inc": bson.M{"used": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"used": 1}),
+	).Decode(&url)
+	if err == mongo.ErrNoDocuments {
+		return 0, ErrLimitReached
+	}
+	return url.Used, err
+}
+
+func (m *MongoStore) SyncUsage(ctx context.Context, id string, used int) error {
+	_, err := m.links.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$max": bson.M{"used": used}})
+	return err
+}
+
+func (m *MongoStore) CountActive(ctx context.Context) (int64, error) {
+	return m.links.CountDocuments(ctx, activeFilter())
+}
+
+func (m *MongoStore) EachID(ctx context.Context, fn func(id string) error) error {
+	cur, err := m.links.Find(ctx, bson.M{},
+		options.Find().SetProjection(bson.M{"_id": 1}).SetBatchSize(1000))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var doc struct {
+			ID string `bson:"_id"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return err
+		}
+		if err := fn(doc.ID); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func (m *MongoStore) ListLinks(ctx context.Context, q LinkQuery) ([]URL, error) {
+	filter := ownerFilter(bson.M{"deleted_at": bson.M{"$exists": false}}, q.Owner)
+	if q.Tag != "" {
+		filter["tags"] = q.Tag
+	}
+	if q.Domain != "" {
+		filter["domain"] = q.Domain
+	}
+	created := bson.M{}
+	if !q.CreatedAfter.IsZero() {
+		created["$gte"] = q.CreatedAfter
+	}
+	if !q.CreatedBefore.IsZero() {
+		created["$lt"] = q.CreatedBefore
+	}
+	if len(created) > 0 {
+		filter["created_at"] = created
+	}
+	switch now := time.Now(); q.Expiry {
+	case ExpiryPermanent:
+		filter["expire_at"] = bson.M{"$exists": false}
+	case ExpiryExpiring:
+		filter["expire_at"] = bson.M{"$gt": now}
+	case ExpiryExpired:
+		filter["expire_at"] = bson.M{"$lte": now}
+	}
+
+	key, dir, op := "created_at", -1, "$lt"
+	if q.Sort == SortClicks {
+		key = "clicks"
+	}
+	if q.Ascending {
+		dir, op = 1, "$gt"
+	}
+	if c := q.After; c != nil {
+		var v interface{} = c.CreatedAt
+		if q.Sort == SortClicks {
+			v = c.Clicks
+		}
+		filter["$or"] = bson.A{
+			bson.M{key: bson.M{op: v}},
+			bson.M{key: v, "_id": bson.M{op: c.ID}},
+		}
+	}
+
+	cur, err := m.links.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: key, Value: dir}, {Key: "_id", Value: dir}}).
+		SetLimit(int64(q.Limit)))
+	if err != nil {
+		return nil, err
+	}
+	urls := []URL{}
+	if err := cur.All(ctx, &urls); err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+func activeFilter() bson.M {
+	return bson.M{
+		"deleted_at": bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"expire_at": bson.M{"$exists": false}},
+			bson.M{"expire_at": bson.M{"$gt": time.Now()}},
+		},
+	}
+}
+
+func (m *MongoStore) RecordClicks(ctx context.Context, clicks []Click) error {
+	docs := make([]interface{}, len(clicks))
+	for i, click := range clicks {
+		docs[i] = click
+	}
+	if _, err := m.clicks.InsertMany(ctx, docs); err != nil {
+		return err
+	}
+
+	stamps := make(map[string]bson.A)
+	for _, click := range clicks {
+		stamps[click.ShortID] = append(stamps[click.ShortID], click.Timestamp)
+	}
+	models := make([]mongo.WriteModel, 0, len(stamps))
+	for id, ts := range stamps {
+		// Only count the events from after the link was created; earlier
+		// ones were queued for a tombstone this link has replaced.
+		added := bson.M{"$size": bson.M{"$filter": bson.M{
+			"input": ts,
+			"cond":  bson.M{"$gte": bson.A{"$$this", "$created_at"}},
+		}}}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetUpdate(mongo.Pipeline{{{Key: "$set", Value: bson.M{
+				"clicks": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$clicks", 0}}, added}},
+			}}}}))
+	}
+	_, err := m.links.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (m *MongoStore) ClickStats(ctx context.Context, id string, created, hourlySince, dailySince time.Time) (ClickStats, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"short_id": id, "ts": bson.M{"$gte": created}}}},
+		{{Key: "$facet", Value: bson.M{
+			"total": bson.A{
+				bson.M{"$count": "clicks"},
+			},
+			"visitors": bson.A{
+				bson.M{"$group": bson.M{"_id": "$visitor"}},
+				bson.M{"$count": "visitors"},
+			},
+			"hourly": bson.A{
+				bson.M{"$match": bson.M{"ts": bson.M{"$gte": hourlySince}}},
+				bson.M{"$group": bson.M{
+					"_id":    bson.M{"$dateToString": bson.M{"format": "%Y-%m-%dT%H:00Z", "date": "$ts"}},
+					"clicks": bson.M{"$sum": 1},
+				}},
+				bson.M{"$sort": bson.M{"_id": 1}},
+			},
+			"daily": bson.A{
+				bson.M{"$match": bson.M{"ts": bson.M{"$gte": dailySince}}},
+				bson.M{"$group": bson.M{
+					"_id":    bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$ts"}},
+					"clicks": bson.M{"$sum": 1},
+				}},
+				bson.M{"$sort": bson.M{"_id": 1}},
+			},
+		}}},
+	}
+
+	var stats ClickStats
+	cur, err := m.clicks.Aggregate(ctx, pipeline)
+	if err != nil {
+		return stats, err
+	}
+	var results []struct {
+		Total    []struct{ Clicks int }   `bson:"total"`
+		Visitors []struct{ Visitors int } `bson:"visitors"`
+		Hourly   []ClickBucket            `bson:"hourly"`
+		Daily    []ClickBucket            `bson:"daily"`
+	}
+	if err := cur.All(ctx, &results); err != nil {
+		return stats, err
+	}
+	if len(results) == 0 {
+		return stats, nil
+	}
+
+	r := results[0]
+	if len(r.Total) > 0 {
+		stats.Total = r.Total[0].Clicks
+	}
+	if len(r.Visitors) > 0 {
+		stats.Unique = r.Visitors[0].Visitors
+	}
+	stats.Hourly, stats.Daily = r.Hourly, r.Daily
+	return stats, nil
+}
+
+func (m *MongoStore) CreateAPIKey(ctx context.Context, key APIKey) error {
+	_, err := m.keys.InsertOne(ctx, key)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (m *MongoStore) APIKey(ctx context.Context, hash string) (APIKey, error) {
+	var key APIKey
+	err := m.keys.FindOne(ctx, bson.M{"_id": hash}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return key, ErrNotFound
+	}
+	return key, err
+}
+
+func (m *MongoStore) Ping(ctx context.Context) error {
+	return m.links.Database().Client().Ping(ctx, readpref.Primary())
+}
+
+func ownerFilter(filter bson.M, owner string) bson.M {
+	if owner != "" {
+		filter["owner"] = owner
+	}
+	return filter
+}
+
+// versionMatch matches documents written before versioning as version 0.
+func versionMatch(v int) interface{} {
+	if v == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return v
+}
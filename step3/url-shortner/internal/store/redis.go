@@ -0,0 +1,148 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisCache struct {
+	client redis.UniversalClient
+}
+
+func NewRedisCache(client redis.UniversalClient) *RedisCache {
+	return &RedisCache{client: client}
+}
+
+func (r *RedisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := r.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrCacheMiss
+	}
+	return b, err
+}
+
+func (r *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return r.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (r *RedisCache) SetMany(ctx context.Context, entries []CacheEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	pipe := r.client.Pipeline()
+	for _, e := range entries {
+		pipe.Set(ctx, e.Key, e.Value, e.TTL)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *RedisCache) Del(ctx context.Context, keys ...string) error {
+	return r.client.Del(ctx, keys...).Err()
+}
+
+func (r *RedisCache) Incr(ctx context.Context, key string) (int64, error) {
+	return r.client.Incr(ctx, key).Result()
+}
+
+// incrBounded returns the new count, -1 when the limit is reached and -2
+// when the key is missing and no seed was given.
+var incrBounded = redis.NewScript(`
+local used = redis.call('GET', KEYS[1])
+if not used then
+  if ARGV[2] == '' then
+    return -2
+  end
+  used = ARGV[2]
+end
+used = tonumber(used)
+if used >= tonumber(ARGV[1]) then
+  return -1
+end
+used = used + 1
+if tonumber(ARGV[3]) > 0 then
+  redis.call('SET', KEYS[1], used, 'PX', ARGV[3])
+else
+  redis.call('SET', KEYS[1], used)
+end
+return used
+`)
+
+func (r *RedisCache) IncrBounded(ctx context.Context, key string, max int64, seed *int64, ttl time.Duration) (int64, error) {
+	var seedArg string
+	if seed != nil {
+		seedArg = strconv.FormatInt(*seed, 10)
+	}
+	n, err := incrBounded.Run(ctx, r.client, []string{key}, max, seedArg, ttl.Milliseconds()).Int64()
+	switch {
+	case err != nil:
+		return 0, err
+	case n == -1:
+		return 0, ErrLimitReached
+	case n == -2:
+		return 0, ErrCacheMiss
+	}
+	return n, nil
+}
+
+// slidingWindow keeps one sorted-set member per request scored by Redis
+// server time, so every replica sees the same window regardless of local
+// clock skew. It returns {allowed, count, ms until the oldest entry leaves}.
+var slidingWindow = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], 0, now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+  redis.call('ZADD', KEYS[1], now, ARGV[3])
+  count = count + 1
+  allowed = 1
+end
+redis.call('PEXPIRE', KEYS[1], window)
+
+local reset = window
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+if oldest[2] then
+  reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, count, reset}
+`)
+
+func (r *RedisCache) SlidingWindow(ctx context.Context, key string, limit int, window time.Duration) (WindowResult, error) {
+	token := nonce()
+	res, err := slidingWindow.Run(ctx, r.client, []string{key},
+		window.Milliseconds(), limit, token,
+	).Int64Slice()
+	if err != nil {
+		return WindowResult{}, err
+	}
+	return WindowResult{
+		Allowed: res[0] == 1,
+		Count:   int(res[1]),
+		Reset:   time.Duration(res[2]) * time.Millisecond,
+		Token:   token,
+	}, nil
+}
+
+func (r *RedisCache) Uncount(ctx context.Context, key, token string) error {
+	return r.client.ZRem(ctx, key, token).Err()
+}
+
+func (r *RedisCache) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+func nonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,322 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrDeleted is returned with the tombstone of a deleted link.
+	ErrDeleted   = errors.New("deleted")
+	ErrDuplicate = errors.New("duplicate key")
+	ErrCacheMiss = errors.New("cache miss")
+	// ErrLimitReached is returned when a link has no clicks left.
+	ErrLimitReached = errors.New("click limit reached")
+	// ErrCacheUnavailable is returned without contacting Redis while the
+	// cache circuit breaker is open.
+	ErrCacheUnavailable = errors.New("cache unavailable")
+)
+
+type URL struct {
+	ID        string     `bson:"_id" json:"id"`
+	Original  string     `bson:"original_url" json:"original_url"`
+	CreatedAt time.Time  `bson:"created_at" json:"created_at"`
+	ExpireAt  *time.Time `bson:"expire_at,omitempty" json:"expire_at,omitempty"`
+	Alias     bool       `bson:"alias,omitempty" json:"alias,omitempty"`
+	Owner     string     `bson:"owner,omitempty" json:"owner,omitempty"`
+	Version   int        `bson:"version" json:"version"`
+
+	RedirectCode int `bson:"redirect_code,omitempty" json:"redirect_code,omitempty"`
+	// Interstitial shows the preview page instead of redirecting straight
+	// away.
+	Interstitial bool `bson:"interstitial,omitempty" json:"interstitial,omitempty"`
+	// PasswordHash is the bcrypt hash of the password protecting the link.
+	// It never leaves the service.
+	PasswordHash string `bson:"password_hash,omitempty" json:"-"`
+	// MaxClicks limits how often the link can be followed; 0 is unlimited.
+	// Used is the number of clicks consumed so far. It may trail the Redis
+	// counter, which is the authority while it exists.
+	MaxClicks int `bson:"max_clicks,omitempty" json:"max_clicks,omitempty"`
+	Used      int `bson:"used,omitempty" json:"used,omitempty"`
+	// ActivateAt is when the link goes live. Until then it resolves to
+	// FallbackURL, if set, and never reveals Original.
+	ActivateAt  *time.Time `bson:"activate_at,omitempty" json:"activate_at,omitempty"`
+	FallbackURL string     `bson:"fallback_url,omitempty" json:"fallback_url,omitempty"`
+
+	Tags []string `bson:"tags,omitempty" json:"tags,omitempty"`
+	// Domain is the host of Original, kept alongside it for filtering.
+	Domain string `bson:"domain,omitempty" json:"domain,omitempty"`
+	// Clicks counts recorded clicks. It is always stored, even when 0, so
+	// range queries for cursor pagination match every link.
+	Clicks int64 `bson:"clicks" json:"clicks"`
+
+	// DeletedAt marks a tombstone: the link no longer resolves, but is kept
+	// until PurgeAt so it can be reported as deleted rather than unknown.
+	// Expired links are kept until PurgeAt in the same way.
+	DeletedAt *time.Time `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	PurgeAt   *time.Time `bson:"purge_at,omitempty" json:"-"`
+}
+
+// TargetDomain returns the lowercased host of a target URL, or "" if it
+// cannot be parsed.
+func TargetDomain(original string) string {
+	u, err := url.Parse(original)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// Cursor returns the position of u in a listing.
+func (u URL) Cursor() LinkCursor {
+	return LinkCursor{CreatedAt: u.CreatedAt, Clicks: u.Clicks, ID: u.ID}
+}
+
+func (u URL) Protected() bool {
+	return u.PasswordHash != ""
+}
+
+// Remaining reports how long u stays valid; ok is false for links that
+// never expire.
+func (u URL) Remaining() (d time.Duration, ok bool) {
+	if u.ExpireAt == nil {
+		return 0, false
+	}
+	return time.Until(*u.ExpireAt), true
+}
+
+func (u URL) Deleted() bool {
+	return u.DeletedAt != nil
+}
+
+// reclaimable reports whether the ID of u may be given to a new link.
+func (u URL) reclaimable() bool {
+	return u.Deleted() || u.Expired()
+}
+
+// Pending reports whether u has not gone live yet.
+func (u URL) Pending() bool {
+	return u.ActivateAt != nil && time.Now().Before(*u.ActivateAt)
+}
+
+func (u URL) Expired() bool {
+	d, ok := u.Remaining()
+	return ok && d <= 0
+}
+
+// LinkPatch is a partial update of a URL. Nil fields are left unchanged.
+type LinkPatch struct {
+	Original *string
+	// ExpireAt replaces the expiry when SetExpireAt is true; nil clears it.
+	SetExpireAt bool
+	ExpireAt    *time.Time
+	// RedirectCode of 0 clears the per-link code.
+	RedirectCode *int
+	Interstitial *bool
+	// PasswordHash of "" removes the password.
+	PasswordHash *string
+	// MaxClicks of 0 removes the limit.
+	MaxClicks *int
+	// ActivateAt replaces the activation time when SetActivateAt is true;
+	// nil makes the link live straight away.
+	SetActivateAt bool
+	ActivateAt    *time.Time
+	// FallbackURL of "" removes the fallback.
+	FallbackURL *string
+	// Tags replaces the tags; an empty slice removes them.
+	Tags *[]string
+}
+
+// Sort orders for ListLinks.
+const (
+	SortCreated = "created_at"
+	SortClicks  = "clicks"
+)
+
+// Expiry states for ListLinks.
+const (
+	ExpiryPermanent = "permanent" // no expire_at
+	ExpiryExpiring  = "expiring"  // expires in the future
+	ExpiryExpired   = "expired"   // expired, not yet swept
+)
+
+// LinkQuery selects a page of links. Zero fields do not filter.
+type LinkQuery struct {
+	Owner         string
+	Tag           string
+	Domain        string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Expiry        string
+
+	// Sort is SortCreated or SortClicks, newest or most clicked first
+	// unless Ascending. Ties are broken by ID in the same direction.
+	Sort      string
+	Ascending bool
+	// After resumes the listing behind this link.
+	After *LinkCursor
+	Limit int
+}
+
+// LinkCursor is the position of a link in a listing: its sort key and ID.
+type LinkCursor struct {
+	CreatedAt time.Time `json:"c,omitempty"`
+	Clicks    int64     `json:"n,omitempty"`
+	ID        string    `json:"id"`
+}
+
+// APIKey is stored under the SHA-256 of the key; the plaintext is only ever
+// shown once, when the key is created.
+type APIKey struct {
+	Hash      string    `bson:"_id" json:"-"`
+	Owner     string    `bson:"owner" json:"owner"`
+	Admin     bool      `bson:"admin,omitempty" json:"admin,omitempty"`
+	RateLimit int       `bson:"rate_limit,omitempty" json:"rate_limit,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+
+	// TTL overrides in minutes; 0 keeps the service default.
+	DefaultTTL int `bson:"default_ttl,omitempty" json:"default_ttl,omitempty"`
+	MaxTTL     int `bson:"max_ttl,omitempty" json:"max_ttl,omitempty"`
+}
+
+type Click struct {
+	ShortID   string    `bson:"short_id" json:"short_id"`
+	Timestamp time.Time `bson:"ts" json:"ts"`
+	Referrer  string    `bson:"referrer,omitempty" json:"referrer,omitempty"`
+	Agent     string    `bson:"agent" json:"agent"`
+	Visitor   string    `bson:"visitor" json:"visitor"`
+}
+
+type ClickBucket struct {
+	Period string `bson:"_id" json:"period"`
+	Clicks int    `bson:"clicks" json:"clicks"`
+}
+
+type ClickStats struct {
+	Total  int
+	Unique int
+	Hourly []ClickBucket
+	Daily  []ClickBucket
+}
+
+// Hourly and daily bucket labels, shared by every LinkStore so stats look
+// the same whichever backend produced them.
+const (
+	HourFormat = "2006-01-02T15:00Z"
+	DayFormat  = "2006-01-02"
+)
+
+// LinkStore is the system of record for links, their clicks and API keys.
+type LinkStore interface {
+	// Insert returns ErrDuplicate if the ID is taken. The tombstone of a
+	// deleted or expired link does not take it; it is replaced.
+	Insert(ctx context.Context, url URL) error
+	// InsertMany inserts urls independently and returns one error per url,
+	// nil for the ones that were stored.
+	InsertMany(ctx context.Context, urls []URL) []error
+	// Get returns ErrNotFound for unknown IDs, and the tombstone with
+	// ErrDeleted for deleted links. Expired links are returned as they are.
+	Get(ctx context.Context, id string) (URL, error)
+	// Update applies patch and bumps the version, but only if the link is
+	// still at version, not deleted and, when owner is non-empty, belongs
+	// to owner. Otherwise it returns ErrNotFound.
+	Update(ctx context.Context, id string, version int, owner string, patch LinkPatch) (URL, error)
+	// Delete turns the link into a tombstone if it exists, is not deleted
+	// yet and, when owner is non-empty, belongs to owner. Otherwise it
+	// returns ErrNotFound.
+	Delete(ctx context.Context, id, owner string) error
+	// CountActive counts links that have not expired or been deleted.
+	CountActive(ctx context.Context) (int64, error)
+	// ConsumeClick atomically uses up one click of a link with MaxClicks
+	// and returns the new Used count, or ErrLimitReached when none are left
+	// or the link is gone or deleted.
+	ConsumeClick(ctx context.Context, id string) (int, error)
+	// SyncUsage raises Used to at least used; it never lowers it.
+	SyncUsage(ctx context.Context, id string, used int) error
+	// ListLinks returns up to q.Limit links matching q in its sort order.
+	// Deleted links are left out.
+	ListLinks(ctx context.Context, q LinkQuery) ([]URL, error)
+	// EachID calls fn with the ID of every stored link, tombstones
+	// included, stopping at the first error.
+	EachID(ctx context.Context, fn func(id string) error) error
+
+	// RecordClicks stores click events and adds them to the links' Clicks.
+	// Events from before a link was created belong to an earlier link under
+	// the same ID and are not added.
+	RecordClicks(ctx context.Context, clicks []Click) error
+	// ClickStats counts the clicks on id since created, the link's creation
+	// time, so a reused ID starts from zero. It buckets them by hour since
+	// hourlySince and by day since dailySince, in UTC.
+	ClickStats(ctx context.Context, id string, created, hourlySince, dailySince time.Time) (ClickStats, error)
+
+	// CreateAPIKey returns ErrDuplicate if the hash is taken.
+	CreateAPIKey(ctx context.Context, key APIKey) error
+	// APIKey returns ErrNotFound for unknown hashes.
+	APIKey(ctx context.Context, hash string) (APIKey, error)
+
+	// Ping reports whether the backend is reachable.
+	Ping(ctx context.Context) error
+}
+
+type CacheEntry struct {
+	Key   string
+	Value []byte
+	TTL   time.Duration
+}
+
+type WindowResult struct {
+	Allowed bool
+	Count   int
+	// Reset is how long until the oldest counted request leaves the window.
+	Reset time.Duration
+	// Token identifies the request counted when Allowed, for Uncount.
+	Token string
+}
+
+// Cache is the shared, expiring key-value layer in front of the LinkStore.
+// A TTL of 0 means the entry does not expire.
+type Cache interface {
+	// Get returns ErrCacheMiss for missing keys.
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// SetMany writes entries in one round trip where the backend allows it.
+	SetMany(ctx context.Context, entries []CacheEntry) error
+	Del(ctx context.Context, keys ...string) error
+	// Incr atomically increments the integer stored at key, starting from
+	// 0, and returns the new value. It keeps the key's TTL; new keys do not
+	// expire.
+	Incr(ctx context.Context, key string) (int64, error)
+	// IncrBounded increments the counter at key unless it has reached max,
+	// returning ErrLimitReached in that case. A missing key starts from
+	// *seed, or fails with ErrCacheMiss when seed is nil. A ttl above 0
+	// sets the key's lifetime.
+	IncrBounded(ctx context.Context, key string, max int64, seed *int64, ttl time.Duration) (int64, error)
+	// SlidingWindow counts a request against key unless limit requests were
+	// already seen within window.
+	SlidingWindow(ctx context.Context, key string, limit int, window time.Duration) (WindowResult, error)
+	// Uncount removes a request counted by SlidingWindow, identified by its
+	// result's Token, for requests that turn out not to count.
+	Uncount(ctx context.Context, key, token string) error
+
+	// Ping reports whether the backend is reachable.
+	Ping(ctx context.Context) error
+}
+
+// Filter is a set of link IDs shared by all replicas that may answer "maybe"
+// for IDs that were never added, but never "no" for one that was.
+type Filter interface {
+	Add(ctx context.Context, ids ...string) error
+	// Test reports whether id may exist. It returns ErrCacheMiss while the
+	// filter is not built, and callers must then fall back to the LinkStore.
+	Test(ctx context.Context, id string) (bool, error)
+	// Invalidate drops the filter so Test stops answering until the next
+	// rebuild. Use it when an Add may have been lost.
+	Invalidate(ctx context.Context) error
+	// Refresh rebuilds the filter from each if it is missing or older than
+	// maxAge. Concurrent callers on other replicas skip the rebuild.
+	Refresh(ctx context.Context, maxAge time.Duration, each func(ctx context.Context, fn func(id string) error) error) error
+}